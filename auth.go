@@ -0,0 +1,153 @@
+package sftp_server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// authMethods builds the SSH auth methods from every credential configured on
+// the client, in the order they are tried: the private key, then the agent's
+// keys, then the password, then keyboard-interactive. release must be called
+// once the handshake is over.
+func (c *SFTPClient) authMethods() (methods []ssh.AuthMethod, release func(), err error) {
+	release = func() {}
+
+	var signers []ssh.Signer
+	signer, err := c.keySigner()
+	if err != nil {
+		return nil, nil, err
+	}
+	if signer != nil {
+		signers = append(signers, signer)
+	}
+
+	if c.UseAgent {
+		agentSigners, closeAgent, err := agentSigners()
+		if err != nil {
+			return nil, nil, err
+		}
+		signers = append(signers, agentSigners...)
+		release = closeAgent
+	}
+
+	// The SSH library tries each method once, so all keys share one
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if c.Password != "" {
+		methods = append(methods, ssh.Password(c.Password))
+	}
+
+	if c.KeyboardInteractive != nil {
+		methods = append(methods, ssh.KeyboardInteractive(c.KeyboardInteractive))
+	} else if c.Password != "" {
+		methods = append(methods, ssh.KeyboardInteractive(c.answerWithPassword))
+	}
+
+	// With no credentials at all, send the empty password as always
+	if len(methods) == 0 {
+		methods = append(methods, ssh.Password(c.Password))
+	}
+
+	return methods, release, nil
+}
+
+// agentSigners returns the keys held by the agent at SSH_AUTH_SOCK, along with
+// a func closing the agent connection, which must stay open while the keys
+// are used. Without an agent running there are simply no keys.
+func agentSigners() ([]ssh.Signer, func(), error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, func() {}, nil
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, func() {}, nil
+	}
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return signers, func() { conn.Close() }, nil
+}
+
+// answerWithPassword answers every keyboard-interactive question with the
+// password, which covers servers that use the method for plain password
+// logins.
+func (c *SFTPClient) answerWithPassword(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i := range answers {
+		answers[i] = c.Password
+	}
+	return answers, nil
+}
+
+// isAuthError reports whether err is the SSH handshake rejecting every
+// credential offered.
+func isAuthError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// keySigner parses the configured private key, if any. PrivateKeyPEM takes
+// precedence over PrivateKeyPath.
+func (c *SFTPClient) keySigner() (ssh.Signer, error) {
+	pem := c.PrivateKeyPEM
+	if len(pem) == 0 && c.PrivateKeyPath != "" {
+		var err error
+		pem, err = os.ReadFile(c.PrivateKeyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(pem) == 0 {
+		return nil, nil
+	}
+
+	if c.PrivateKeyPassphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(pem, []byte(c.PrivateKeyPassphrase))
+	}
+	return ssh.ParsePrivateKey(pem)
+}
+
+// hostKeyCallback verifies the server with HostKeyCallback if set, otherwise
+// against KnownHostsPath. Skipping verification has to be requested
+// explicitly with InsecureSkipHostKeyCheck.
+func (c *SFTPClient) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if c.HostKeyCallback != nil {
+		return c.HostKeyCallback, nil
+	}
+	if c.KnownHostsPath == "" {
+		if c.InsecureSkipHostKeyCheck {
+			return ssh.InsecureIgnoreHostKey(), nil
+		}
+		return nil, errors.New("no host key verification configured: set KnownHostsPath, HostKeyCallback or InsecureSkipHostKeyCheck")
+	}
+
+	callback, err := knownhosts.New(c.KnownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	path := c.KnownHostsPath
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				return fmt.Errorf("host key for %s not found in %s: %w", hostname, path, err)
+			}
+			return fmt.Errorf("host key for %s does not match %s, possible man-in-the-middle: %w", hostname, path, err)
+		}
+		return err
+	}, nil
+}
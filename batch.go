@@ -0,0 +1,141 @@
+package sftp_server
+
+import (
+	"io"
+
+	"github.com/pkg/sftp"
+)
+
+// Batch queues operations to run in order over a single connection. Build
+// one with NewBatch, chain the operations and call Execute.
+type Batch struct {
+	// ContinueOnError runs the remaining steps after one fails instead of
+	// stopping there.
+	ContinueOnError bool
+
+	c     *SFTPClient
+	steps []batchStep
+}
+
+type batchStep struct {
+	op   string
+	path string
+	fn   func(client *sftp.Client) ([]byte, error)
+
+	// readOnly steps still run in a dry run
+	readOnly bool
+}
+
+// BatchResult is the outcome of one step of a Batch. Data holds the content
+// returned by Read steps.
+type BatchResult struct {
+	Op   string
+	Path string
+	Data []byte
+	Err  error
+}
+
+// NewBatch returns an empty batch that runs against c.
+func (c *SFTPClient) NewBatch() *Batch {
+	return &Batch{c: c}
+}
+
+func (b *Batch) add(op, filePath string, fn func(client *sftp.Client) ([]byte, error)) *Batch {
+	b.steps = append(b.steps, batchStep{op: op, path: filePath, fn: fn})
+	return b
+}
+
+// Append queues appending data to filePath, creating it if needed.
+func (b *Batch) Append(filePath string, data string) *Batch {
+	filePath = b.c.resolve(filePath)
+	return b.add("append", filePath, func(client *sftp.Client) ([]byte, error) {
+		return nil, appendBytes(client, filePath, []byte(data))
+	})
+}
+
+// Overwrite queues replacing the content of filePath with data.
+func (b *Batch) Overwrite(filePath string, data string) *Batch {
+	filePath = b.c.resolve(filePath)
+	return b.add("overwrite", filePath, func(client *sftp.Client) ([]byte, error) {
+		return nil, overwriteBytes(client, filePath, []byte(data))
+	})
+}
+
+// Mkdir queues creating dirPath along with any missing parents.
+func (b *Batch) Mkdir(dirPath string) *Batch {
+	dirPath = b.c.resolve(dirPath)
+	return b.add("mkdir", dirPath, func(client *sftp.Client) ([]byte, error) {
+		return nil, client.MkdirAll(dirPath)
+	})
+}
+
+// Delete queues removing filePath.
+func (b *Batch) Delete(filePath string) *Batch {
+	filePath = b.c.resolve(filePath)
+	return b.add("remove", filePath, func(client *sftp.Client) ([]byte, error) {
+		return nil, client.Remove(filePath)
+	})
+}
+
+// Rename queues moving oldPath to newPath.
+func (b *Batch) Rename(oldPath, newPath string) *Batch {
+	oldPath = b.c.resolve(oldPath)
+	newPath = b.c.resolve(newPath)
+	return b.add("rename", oldPath, func(client *sftp.Client) ([]byte, error) {
+		return nil, client.Rename(oldPath, newPath)
+	})
+}
+
+// Read queues reading filePath, whose content ends up in the step's result.
+func (b *Batch) Read(filePath string) *Batch {
+	filePath = b.c.resolve(filePath)
+	read := func(client *sftp.Client) ([]byte, error) {
+		_, err := statRegular(client, filePath)
+		if err != nil {
+			return nil, err
+		}
+		f, err := client.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+	b.steps = append(b.steps, batchStep{op: "read", path: filePath, fn: read, readOnly: true})
+	return b
+}
+
+// Execute runs the queued steps in order on one connection and returns a
+// result for every step that ran. The error is that of the first failed
+// step, or of connecting. Unless ContinueOnError is set, no step runs after
+// a failure.
+func (b *Batch) Execute() ([]BatchResult, error) {
+	results := make([]BatchResult, 0, len(b.steps))
+	var firstErr error
+	err := b.c.withClient("batch", "", func(client *sftp.Client) error {
+		for _, step := range b.steps {
+			if !step.readOnly && b.c.dryRun(step.op, step.path) {
+				results = append(results, BatchResult{Op: step.op, Path: step.path})
+				continue
+			}
+
+			done := b.c.trace(step.op, step.path)
+			data, err := step.fn(client)
+			done(err)
+
+			err = opError(step.op, step.path, err)
+			results = append(results, BatchResult{Op: step.op, Path: step.path, Data: data, Err: err})
+			if err != nil && firstErr == nil {
+				firstErr = err
+				if !b.ContinueOnError {
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return results, err
+	}
+	return results, firstErr
+}
@@ -0,0 +1,105 @@
+package sftp_server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Errors returned by SFTPClient can be tested against these with errors.Is.
+var (
+	// ErrNotFound means the path does not exist on the server.
+	ErrNotFound = errors.New("file not found")
+
+	// ErrPermission means the server refused access to the path.
+	ErrPermission = errors.New("permission denied")
+
+	// ErrConnect means no connection to the server could be established.
+	ErrConnect = errors.New("connection failed")
+
+	// ErrAuth means the server rejected every credential offered.
+	ErrAuth = errors.New("authentication failed")
+
+	// ErrHostKey means the server's host key failed verification, against
+	// KnownHostsPath or by HostKeyCallback.
+	ErrHostKey = errors.New("host key rejected")
+
+	// ErrUnsupported means the server lacks the protocol extension an
+	// operation needs.
+	ErrUnsupported = errors.New("operation not supported by the server")
+
+	// ErrChecksumMismatch means a transferred file read back differently
+	// from the data that was sent.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrFileTooLarge means a file is larger than the read limit set.
+	ErrFileTooLarge = errors.New("file too large")
+
+	// ErrNotRegular means a read was refused because the path is a FIFO,
+	// device or other special file, which could block forever.
+	ErrNotRegular = errors.New("not a regular file")
+
+	// ErrInvalidGzip means a file read as gzip is corrupt or truncated.
+	ErrInvalidGzip = errors.New("not a valid gzip file")
+
+	// ErrDryRun means an operation was refused because DryRun is set and it
+	// could not be skipped safely.
+	ErrDryRun = errors.New("refused in dry run")
+
+	// ErrNotOpen means the method needs the connection established by Open.
+	ErrNotOpen = errors.New("connection not open")
+)
+
+// OpError records the operation and path an error occurred on.
+type OpError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("%s %q: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Is maps the standard library errors the SFTP client reports onto the
+// package's sentinel errors.
+func (e *OpError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return errors.Is(e.Err, os.ErrNotExist)
+	case ErrPermission:
+		return errors.Is(e.Err, os.ErrPermission)
+	}
+	return false
+}
+
+// opError annotates err with the operation and the path it failed on. The
+// original error stays reachable through errors.Unwrap.
+func opError(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &OpError{Op: op, Path: path, Err: err}
+}
+
+// connectError marks an error as a failure to connect, either ErrAuth or
+// ErrConnect, while keeping the underlying cause.
+type connectError struct {
+	kind error
+	err  error
+}
+
+func newConnectError(err error) error {
+	if isAuthError(err) {
+		return &connectError{kind: ErrAuth, err: err}
+	}
+	return &connectError{kind: ErrConnect, err: err}
+}
+
+func (e *connectError) Error() string        { return e.err.Error() }
+func (e *connectError) Unwrap() error        { return e.err }
+func (e *connectError) Is(target error) bool { return target == e.kind }
@@ -0,0 +1,137 @@
+package sftp_server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// Glob returns the server-absolute paths matching pattern, using the syntax
+// of path.Match. Relative patterns are resolved against the login directory.
+func (c *SFTPClient) Glob(pattern string) ([]string, error) {
+	pattern = c.resolve(pattern)
+	var matches []string
+	err := c.withClientRetry(context.Background(), "glob", pattern, func(client *sftp.Client) error {
+		var err error
+		matches, err = client.Glob(pattern)
+		if err != nil || path.IsAbs(pattern) {
+			return err
+		}
+
+		wd, err := client.Getwd()
+		if err != nil {
+			return err
+		}
+		for i, match := range matches {
+			matches[i] = path.Join(wd, match)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// RecursiveGlob is like Glob but also accepts "**" as a whole path element,
+// matching any number of directories, none included: "logs/**/*.err" matches
+// both logs/a.err and logs/x/y/b.err. The tree below the last element
+// without wildcards is walked without following symlinks, and directories
+// that cannot be read are skipped. The matches are returned sorted.
+func (c *SFTPClient) RecursiveGlob(pattern string) ([]string, error) {
+	pattern = c.resolve(pattern)
+	var matches []string
+	err := c.withClientRetry(context.Background(), "glob", pattern, func(client *sftp.Client) error {
+		matches = nil
+		if !path.IsAbs(pattern) {
+			wd, err := client.Getwd()
+			if err != nil {
+				return err
+			}
+			pattern = path.Join(wd, pattern)
+		}
+
+		parts := strings.Split(strings.TrimPrefix(path.Clean(pattern), "/"), "/")
+		for _, part := range parts {
+			if _, err := path.Match(part, ""); err != nil {
+				return err
+			}
+		}
+
+		// Start walking from the deepest directory free of wildcards
+		n := 0
+		for n < len(parts) && !strings.ContainsAny(parts[n], `*?[\`) {
+			n++
+		}
+		base := "/" + strings.Join(parts[:n], "/")
+		rest := parts[n:]
+
+		info, err := client.Lstat(base)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(rest) == 0 {
+			matches = []string{base}
+			return nil
+		}
+
+		deep := false
+		for _, part := range rest {
+			deep = deep || part == "**"
+		}
+
+		err = walk(context.Background(), client, base, info, func(p string, info os.FileInfo, err error) error {
+			if err != nil || p == base {
+				return nil
+			}
+			name := strings.Split(strings.TrimPrefix(p[len(base):], "/"), "/")
+			if matchElements(rest, name) {
+				matches = append(matches, p)
+			}
+			// Without ** nothing deeper than the pattern can match
+			if info.IsDir() && !deep && len(name) >= len(rest) {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		sort.Strings(matches)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// matchElements reports whether the path elements in name match those in
+// pattern, where a "**" element matches any number of elements.
+func matchElements(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElements(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
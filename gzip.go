@@ -0,0 +1,116 @@
+package sftp_server
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/pkg/sftp"
+)
+
+// ReadFileGzip reads the gzip-compressed filePath and returns its
+// decompressed content. A corrupt or truncated file fails with
+// ErrInvalidGzip.
+func (c *SFTPClient) ReadFileGzip(filePath string) ([]byte, error) {
+	filePath = c.resolve(filePath)
+	var data []byte
+	err := c.withClientRetry(context.Background(), "read", filePath, func(client *sftp.Client) error {
+		var err error
+		data, err = readGzip(client, filePath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readGzip reads and decompresses filePath.
+func readGzip(client *sftp.Client, filePath string) ([]byte, error) {
+	_, err := statRegular(client, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := client.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	src := &errReader{r: f}
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, gzipError(src, err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, gzipError(src, err)
+	}
+	return data, nil
+}
+
+// errReader remembers the first error other than io.EOF its reader returns.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(b []byte) (int, error) {
+	n, err := e.r.Read(b)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// gzipError reports err, returned while decompressing src, as
+// ErrInvalidGzip unless reading src itself failed. The cause is kept out of
+// the chain: an empty or truncated file yields io.EOF or
+// io.ErrUnexpectedEOF, which would otherwise pass for a network failure.
+func gzipError(src *errReader, err error) error {
+	if src.err != nil {
+		return src.err
+	}
+	return fmt.Errorf("%w: %v", ErrInvalidGzip, err)
+}
+
+// WriteFileGzip creates or truncates filePath with data compressed by gzip
+// at the default level. The name is used as given, so include the .gz
+// extension if one is wanted.
+func (c *SFTPClient) WriteFileGzip(filePath string, data []byte) error {
+	return c.WriteFileGzipLevel(filePath, data, gzip.DefaultCompression)
+}
+
+// WriteFileGzipLevel is WriteFileGzip with a compression level from
+// gzip.HuffmanOnly to gzip.BestCompression.
+func (c *SFTPClient) WriteFileGzipLevel(filePath string, data []byte, level int) error {
+	filePath = c.resolve(filePath)
+	if c.dryRun("write", filePath) {
+		return nil
+	}
+	return c.withClient("write", filePath, func(client *sftp.Client) error {
+		// Check the level before touching the file
+		zw, err := gzip.NewWriterLevel(io.Discard, level)
+		if err != nil {
+			return err
+		}
+
+		f, err := client.Create(filePath)
+		if err != nil {
+			return err
+		}
+		zw.Reset(f)
+
+		_, err = zw.Write(data)
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+}
@@ -0,0 +1,50 @@
+package sftp_server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadGzipInvalid(t *testing.T) {
+	var valid bytes.Buffer
+	zw := gzip.NewWriter(&valid)
+	zw.Write(bytes.Repeat([]byte("hello "), 100))
+	zw.Close()
+
+	// Flip bits in the deflate body, past the 10-byte header
+	corrupt := append([]byte(nil), valid.Bytes()...)
+	for i := 12; i < 20; i++ {
+		corrupt[i] ^= 0xff
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not gzip", []byte("plain text")},
+		{"corrupt body", corrupt},
+		{"truncated", valid.Bytes()[:valid.Len()/2]},
+	}
+	client := newPipeClient(t)
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(dir, tt.name+".gz")
+			if err := os.WriteFile(p, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readGzip(client, filepath.ToSlash(p))
+			if !errors.Is(err, ErrInvalidGzip) {
+				t.Fatalf("readGzip() error = %v, want ErrInvalidGzip", err)
+			}
+			if isRetryable(err) {
+				t.Errorf("readGzip() error %v is retryable", err)
+			}
+		})
+	}
+}
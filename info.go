@@ -0,0 +1,74 @@
+package sftp_server
+
+import (
+	"context"
+)
+
+// ServerInfo describes what the server advertised when the connection was
+// set up.
+type ServerInfo struct {
+	// SSHVersion is the server's SSH identification string, such as
+	// "SSH-2.0-OpenSSH_9.0".
+	SSHVersion string
+
+	// SFTPVersion is the negotiated SFTP protocol version. The sftp package
+	// only speaks version 3, so it is always 3.
+	SFTPVersion int
+
+	// Extensions maps the protocol extensions the server supports to their
+	// advertised version.
+	Extensions map[string]string
+}
+
+// knownExtensions are the extensions ServerInfo looks for. The sftp package
+// answers whether a given extension was advertised but cannot list them.
+var knownExtensions = []string{
+	"posix-rename@openssh.com",
+	"statvfs@openssh.com",
+	"fstatvfs@openssh.com",
+	"hardlink@openssh.com",
+	"fsync@openssh.com",
+	"lsetstat@openssh.com",
+	"limits@openssh.com",
+	"expand-path@openssh.com",
+	"copy-data",
+	"home-directory",
+	"users-groups-by-id@openssh.com",
+	"check-file",
+	"check-file-name",
+	"check-file-handle",
+	"space-available",
+}
+
+// ServerInfo reports the server's SSH version, SFTP protocol version and
+// supported extensions, using the open connection if there is one. It sends
+// no requests once connected, so OperationTimeout does not apply.
+func (c *SFTPClient) ServerInfo() (ServerInfo, error) {
+	ctx := context.Background()
+	s, err := c.acquire(ctx)
+	if err != nil {
+		return ServerInfo{}, opError("serverinfo", c.address(), err)
+	}
+	defer func() { c.release(s) }()
+
+	// Nothing is sent that could fail, so only a connection already known
+	// to be gone, such as one the keepalive gave up on, is replaced
+	if s.closed() && c.Reconnect {
+		if ns, ok := c.reopen(ctx, s); ok {
+			c.release(s)
+			s = ns
+		}
+	}
+
+	info := ServerInfo{
+		SSHVersion:  string(s.conn.ServerVersion()),
+		SFTPVersion: 3,
+		Extensions:  make(map[string]string),
+	}
+	for _, name := range knownExtensions {
+		if version, ok := s.client.HasExtension(name); ok {
+			info.Extensions[name] = version
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,49 @@
+package sftp_server
+
+import (
+	"time"
+)
+
+// Logger receives diagnostics from SFTPClient: connections being opened and
+// closed, and the start, duration and outcome of every operation. Failures
+// are logged with Infof, everything else with Debugf.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+
+func (c *SFTPClient) logger() Logger {
+	if c.Logger == nil {
+		return nopLogger{}
+	}
+	return c.Logger
+}
+
+// dryRun reports whether DryRun is set, logging op on path as skipped if so.
+func (c *SFTPClient) dryRun(op, path string) bool {
+	if !c.DryRun {
+		return false
+	}
+	c.logger().Infof("dry run: %s %q skipped", op, path)
+	return true
+}
+
+// trace logs the start of op and returns a func that logs its outcome.
+func (c *SFTPClient) trace(op, path string) func(err error) {
+	log := c.logger()
+	log.Debugf("%s %q started", op, path)
+	start := time.Now()
+
+	return func(err error) {
+		if err != nil {
+			log.Infof("%s %q failed after %s: %v", op, path, time.Since(start), err)
+			return
+		}
+		log.Debugf("%s %q finished in %s", op, path, time.Since(start))
+	}
+}
@@ -0,0 +1,137 @@
+package sftp_server
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrPoolClosed is returned by Pool.Acquire once the pool has been closed.
+var ErrPoolClosed = errors.New("pool closed")
+
+// Pool shares a bounded number of open connections between goroutines. Each
+// connection is an SFTPClient on which Open has been called.
+type Pool struct {
+	newClient func() *SFTPClient
+
+	// slots holds a token for every client handed out, capping concurrency
+	slots chan struct{}
+	idle  chan *SFTPClient
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewPool returns a pool of at most size connections, each made from a client
+// returned by newClient. Connections are opened lazily on Acquire. A size
+// below 1 is treated as 1.
+func NewPool(size int, newClient func() *SFTPClient) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	return &Pool{
+		newClient: newClient,
+		slots:     make(chan struct{}, size),
+		idle:      make(chan *SFTPClient, size),
+	}
+}
+
+// Acquire returns a connected client, waiting for one to be released if the
+// pool is at capacity. Idle connections are checked before being handed out
+// and replaced if they have died. The client must be given back with Release.
+func (p *Pool) Acquire(ctx context.Context) (*SFTPClient, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		<-p.slots
+		return nil, ErrPoolClosed
+	}
+
+	for {
+		select {
+		case c := <-p.idle:
+			if c.alive(ctx) {
+				return c, nil
+			}
+			c.Close()
+			continue
+		default:
+		}
+		break
+	}
+
+	c := p.newClient()
+	err := c.open(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// Release returns a client obtained from Acquire to the pool.
+func (p *Pool) Release(c *SFTPClient) {
+	p.mu.Lock()
+	if p.closed {
+		c.Close()
+	} else {
+		p.idle <- c
+	}
+	p.mu.Unlock()
+
+	<-p.slots
+}
+
+// Close closes the idle connections and makes the pool close every client
+// released from now on.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	var err error
+	for {
+		select {
+		case c := <-p.idle:
+			if cerr := c.Close(); err == nil {
+				err = cerr
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// alive reports whether the connection established by Open still answers
+// before ctx is done, and within OperationTimeout or, failing that, the
+// connect timeout.
+func (c *SFTPClient) alive(ctx context.Context) bool {
+	c.mu.Lock()
+	s := c.session
+	c.mu.Unlock()
+
+	if s == nil {
+		return false
+	}
+
+	timeout := c.OperationTimeout
+	if timeout <= 0 {
+		timeout = c.timeout()
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// A connection that stops answering without closing would block the
+	// request forever. It is thrown away either way, so just close it
+	stop := watch(ctx, func() { s.close() })
+	_, err := s.client.Getwd()
+	stop()
+	return err == nil && ctx.Err() == nil
+}
@@ -0,0 +1,231 @@
+package sftp_server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+)
+
+// ResumableUpload uploads localPath to remotePath, continuing from where an
+// earlier, interrupted upload stopped: whatever is already on the server is
+// taken to be the start of the local file and only the rest is sent. It
+// returns the number of bytes sent by this call.
+func (c *SFTPClient) ResumableUpload(localPath, remotePath string) (int64, error) {
+	return c.ResumableUploadWithOptions(localPath, remotePath, TransferOptions{})
+}
+
+// ResumableUploadWithOptions is ResumableUpload honouring opts. NoOverwrite
+// is ignored, since resuming means writing to an existing file. Verify
+// checks the whole file, including the part sent earlier.
+func (c *SFTPClient) ResumableUploadWithOptions(localPath, remotePath string, opts TransferOptions) (int64, error) {
+	remotePath = c.resolve(remotePath)
+	if c.dryRun("upload", remotePath) {
+		return 0, nil
+	}
+	var written int64
+	err := c.withClient("upload", remotePath, func(client *sftp.Client) error {
+		var err error
+		written, err = c.resumeUpload(client, localPath, remotePath, opts)
+		return err
+	})
+	return written, err
+}
+
+func (c *SFTPClient) resumeUpload(client *sftp.Client, localPath, remotePath string, opts TransferOptions) (int64, error) {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var offset int64
+	remote, err := client.Stat(remotePath)
+	switch {
+	case err == nil:
+		offset = remote.Size()
+	case errors.Is(err, os.ErrNotExist):
+		err = client.MkdirAll(path.Dir(remotePath))
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, err
+	}
+	if offset > info.Size() {
+		return 0, fmt.Errorf("remote file is %d bytes, more than the %d byte local file", offset, info.Size())
+	}
+
+	_, err = src.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	// Write at the offset rather than relying on O_APPEND, which not every
+	// server honours
+	dst, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return 0, err
+	}
+	_, err = dst.Seek(offset, io.SeekStart)
+	if err != nil {
+		dst.Close()
+		return 0, err
+	}
+
+	r := newThrottledReader(src, c.BandwidthLimit)
+	if opts.Progress != nil {
+		r = io.TeeReader(r, &progress{fn: opts.Progress, transferred: offset, total: info.Size()})
+	}
+
+	written, err := io.Copy(dst, r)
+	if err != nil {
+		dst.Close()
+		return written, err
+	}
+	err = dst.Close()
+	if err != nil {
+		return written, err
+	}
+
+	if opts.Verify {
+		sum, err := hashLocal(localPath)
+		if err != nil {
+			return written, err
+		}
+		err = verifyRemote(client, remotePath, sum)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if opts.preserveMode() {
+		err = client.Chmod(remotePath, info.Mode().Perm())
+		if err != nil {
+			return written, err
+		}
+	}
+	if opts.preserveModTime() {
+		err = client.Chtimes(remotePath, info.ModTime(), info.ModTime())
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ResumableDownload downloads remotePath to localPath, continuing from where
+// an earlier, interrupted download stopped: an existing local file is taken
+// to be the start of the remote file and only the rest is fetched. If the
+// remote file is now smaller than the local one, it was truncated or
+// replaced, and the download starts over. It returns the number of bytes
+// fetched by this call.
+func (c *SFTPClient) ResumableDownload(remotePath, localPath string) (int64, error) {
+	return c.ResumableDownloadWithOptions(remotePath, localPath, TransferOptions{})
+}
+
+// ResumableDownloadWithOptions is ResumableDownload honouring opts, apart
+// from NoOverwrite.
+func (c *SFTPClient) ResumableDownloadWithOptions(remotePath, localPath string, opts TransferOptions) (int64, error) {
+	remotePath = c.resolve(remotePath)
+	var written int64
+	err := c.withClient("download", remotePath, func(client *sftp.Client) error {
+		var err error
+		written, err = c.resumeDownload(client, remotePath, localPath, opts)
+		return err
+	})
+	return written, err
+}
+
+func (c *SFTPClient) resumeDownload(client *sftp.Client, remotePath, localPath string, opts TransferOptions) (int64, error) {
+	info, err := statRegular(client, remotePath)
+	if err != nil {
+		return 0, err
+	}
+
+	src, err := client.Open(remotePath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	err = os.MkdirAll(filepath.Dir(localPath), 0755)
+	if err != nil {
+		return 0, err
+	}
+	dst, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE, info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+
+	local, err := dst.Stat()
+	if err != nil {
+		dst.Close()
+		return 0, err
+	}
+	offset := local.Size()
+	if offset > info.Size() {
+		// The remote file shrank since the last attempt, start over
+		offset = 0
+		err = dst.Truncate(0)
+		if err != nil {
+			dst.Close()
+			return 0, err
+		}
+	}
+
+	_, err = src.Seek(offset, io.SeekStart)
+	if err == nil {
+		_, err = dst.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		dst.Close()
+		return 0, err
+	}
+
+	var w io.Writer = dst
+	if opts.Progress != nil {
+		w = io.MultiWriter(dst, &progress{fn: opts.Progress, transferred: offset, total: info.Size()})
+	}
+
+	written, err := io.Copy(w, newThrottledReader(src, c.BandwidthLimit))
+	if err != nil {
+		dst.Close()
+		return written, err
+	}
+	err = dst.Close()
+	if err != nil {
+		return written, err
+	}
+
+	if opts.preserveModTime() {
+		return written, os.Chtimes(localPath, info.ModTime(), info.ModTime())
+	}
+	return written, nil
+}
+
+// hashLocal returns the SHA-256 of the local file at localPath.
+func hashLocal(localPath string) ([]byte, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
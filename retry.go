@@ -0,0 +1,97 @@
+package sftp_server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// RetryPolicy describes how operations failing with a transient network
+// error are retried. The zero value makes a single attempt.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts int
+
+	// BaseDelay is the wait before the first retry. It doubles after every
+	// attempt, up to MaxDelay if that is set.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// RetryReads also retries operations that only read from the server,
+	// such as ReadFile, Stat and the directory listings. Connecting is
+	// always retried.
+	RetryReads bool
+}
+
+// do calls fn until it succeeds, fails with an error that is not worth
+// retrying, runs out of attempts, or ctx is done.
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	delay := p.BaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if p.MaxDelay > 0 && delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+	}
+}
+
+// isRetryable reports whether err looks like a transient network failure, as
+// opposed to a problem that would recur, such as rejected credentials or a
+// missing file.
+func isRetryable(err error) bool {
+	// connect has already retried as its own policy allows
+	if errors.Is(err, ErrConnect) || errors.Is(err, ErrAuth) {
+		return false
+	}
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrExist) {
+		return false
+	}
+	if errors.Is(err, ErrHostKey) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, sftp.ErrSSHFxConnectionLost) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Only reached when the connect or operation timeout, not the
+		// caller's context, expired
+		return true
+	}
+
+	// The SSH handshake flattens its cause into the message, so failed
+	// authentication can only be told apart by text
+	return strings.Contains(err.Error(), "ssh: handshake failed") && !isAuthError(err)
+}
+
+// withClientRetry is withClientContext for operations that are safe to repeat,
+// retrying them when the policy asks for it.
+func (c *SFTPClient) withClientRetry(ctx context.Context, op, path string, fn func(client *sftp.Client) error) error {
+	if !c.Retry.RetryReads {
+		return c.withSession(ctx, op, path, true, fn)
+	}
+	return c.Retry.do(ctx, func() error {
+		return c.withSession(ctx, op, path, true, fn)
+	})
+}
@@ -0,0 +1,89 @@
+package sftp_server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"eof", io.EOF, true},
+		{"handshake", errors.New("ssh: handshake failed: EOF"), true},
+		{"not found", os.ErrNotExist, false},
+		{"auth", errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password]"), false},
+		{"host key", fmt.Errorf("%w: %v", ErrHostKey, "ssh: handshake failed: ssh: host key mismatch"), false},
+		{"connect", newConnectError(io.EOF), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectHostKeyMismatchNotRetried(t *testing.T) {
+	newSigner := func() ssh.Signer {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(newSigner())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				ssh.NewServerConn(conn, config)
+				conn.Close()
+			}()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	c := &SFTPClient{
+		Username:        "test",
+		IPAddress:       host,
+		Port:            port,
+		HostKeyCallback: ssh.FixedHostKey(newSigner().PublicKey()),
+		ConnectRetries:  2,
+	}
+	err = c.Ping()
+	if !errors.Is(err, ErrHostKey) {
+		t.Fatalf("Ping() error = %v, want ErrHostKey", err)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("dialed %d times, want 1", n)
+	}
+}
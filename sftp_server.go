@@ -1,248 +1,1971 @@
 package sftp_server
 
 import (
+	"context"
+	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"runtime"
+	"sort"
 	"strings"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 
+// DefaultTimeout is used when SFTPClient.Timeout is zero.
+const DefaultTimeout = 30 * time.Second
+
 type SFTPClient struct {
 	Username string
 	Password string
 	IPAddress string
 	Port string
+
+	// PortNumber is an alternative to Port and takes precedence over it when
+	// non-zero. With neither set, port 22 is used.
+	PortNumber int
+
+	// Private key used for public-key auth, either inline or read from a
+	// file. Set PrivateKeyPassphrase if the key is encrypted.
+	//
+	// Every configured credential is offered, in this order: the private
+	// key, the agent's keys, Password, then keyboard-interactive. The
+	// server accepts the first that works.
+	PrivateKeyPEM        []byte
+	PrivateKeyPath       string
+	PrivateKeyPassphrase string
+
+	// UseAgent offers the keys held by the SSH agent at SSH_AUTH_SOCK, if one
+	// is running.
+	UseAgent bool
+
+	// KeyboardInteractive answers keyboard-interactive challenges, such as
+	// one-time passwords. Without it, challenges are answered with Password.
+	KeyboardInteractive ssh.KeyboardInteractiveChallenge
+
+	// known_hosts file the server's host key is checked against. Leaving it
+	// empty is an error unless InsecureSkipHostKeyCheck or HostKeyCallback
+	// is set.
+	KnownHostsPath           string
+	InsecureSkipHostKeyCheck bool
+
+	// HostKeyCallback, if set, verifies the server's host key instead of
+	// KnownHostsPath and InsecureSkipHostKeyCheck, e.g. ssh.FixedHostKey to
+	// pin a single key.
+	HostKeyCallback ssh.HostKeyCallback
+
+	// MaxPacketSize sets the largest SFTP packet the client sends, in bytes.
+	// Servers commonly accept up to 256 KiB, but larger than 32 KiB is not
+	// guaranteed to work. Zero keeps the sftp package's default of 32 KiB.
+	MaxPacketSize int
+
+	// Concurrency is how many requests may be in flight for one file at
+	// once. Raising it, and with ConcurrentWrites allowing writes to overlap
+	// too, helps on high-latency links. Zero keeps the sftp package's
+	// default. DisableConcurrentReads reads files strictly in sequence, for
+	// servers that mishandle overlapping reads.
+	Concurrency            int
+	ConcurrentWrites       bool
+	DisableConcurrentReads bool
+
+	// BasePath, if set, is prepended to every relative remote path passed to
+	// the client's methods, much like changing directory. A relative
+	// BasePath is itself relative to the login directory.
+	BasePath string
+
+	// BandwidthLimit caps DownloadFile and UploadFile throughput in bytes per
+	// second. Zero means unlimited.
+	BandwidthLimit int64
+
+	// JumpHost, if set, is an intermediate SSH server (a bastion) that the
+	// connection to this server is tunnelled through. Only its address,
+	// credentials and host key settings are used.
+	JumpHost *SFTPClient
+
+	// Timeout bounds establishing a connection, from the TCP dial through the
+	// SSH handshake, and defaults to DefaultTimeout. DialTimeout bounds the
+	// TCP dial alone and defaults to Timeout.
+	Timeout     time.Duration
+	DialTimeout time.Duration
+
+	// MaxReadSize, if set, makes ReadFile and ReadFileString fail with
+	// ErrFileTooLarge instead of reading a file larger than this many bytes.
+	MaxReadSize int64
+
+	// OperationTimeout, if set, bounds each operation once connected. When
+	// it expires the connection is closed, aborting the stuck request, and
+	// the operation fails with an error wrapping context.DeadlineExceeded.
+	// It applies to each file of UploadFiles separately. Handles from
+	// OpenReader, OpenWriter and OpenFile, and Tail, are not bounded by it.
+	OperationTimeout time.Duration
+
+	// KeepAliveInterval, if set, makes the connection established by Open
+	// send a keepalive request at that interval. After KeepAliveMaxMissed
+	// consecutive requests (default 3) go unanswered the connection is
+	// closed, failing pending calls instead of leaving them hanging.
+	KeepAliveInterval  time.Duration
+	KeepAliveMaxMissed int
+
+	// Retry controls how transient failures are retried.
+	Retry RetryPolicy
+
+	// ConnectRetries, if set, is how many times a failed connection attempt
+	// is retried, waiting ConnectRetryDelay in between, in place of Retry.
+	// It only affects connecting. Rejected credentials and host keys are
+	// never retried.
+	ConnectRetries    int
+	ConnectRetryDelay time.Duration
+
+	// Reconnect makes an operation that finds the connection established by
+	// Open dead reconnect once, so a long-lived client survives a dropped
+	// connection. Only connection failures trigger it, never errors such as
+	// a missing file. Reads are then run again; writes and other operations
+	// that are not safe to repeat return the error, and the new connection
+	// serves the next call.
+	Reconnect bool
+
+	// Logger, if set, receives connection and per-operation diagnostics.
+	Logger Logger
+
+	// DryRun makes the methods that change the server log each change they
+	// would make, through Logger at Info level, and skip it. Reads still
+	// happen, so SyncToRemote and RemoveDirectoryRecursively report every
+	// file they would touch. OpenWriter and OpenAppender return writers
+	// that discard the data, and OpenFile refuses to open a file for
+	// writing.
+	DryRun bool
+
+	// SSHConfig, if set, is used instead of the configuration built from the
+	// fields above. ConfigureSSH, if set, is called on the configuration
+	// just before dialing, e.g. to enable legacy key exchanges or ciphers.
+	// Transport compression cannot be enabled this way: the SSH library
+	// only implements the "none" method. Compress the data itself instead,
+	// e.g. with WriteFileGzip.
+	SSHConfig    *ssh.ClientConfig
+	ConfigureSSH func(config *ssh.ClientConfig)
+
+	mu      sync.Mutex
+	session *session
+	guard   *leakGuard
+
+	// sshConn is the caller's connection given to NewClientFromSSH
+	sshConn *ssh.Client
+}
+
+// sftpOptions returns the sftp package options matching the tuning fields.
+func (c *SFTPClient) sftpOptions() []sftp.ClientOption {
+	var opts []sftp.ClientOption
+	if c.MaxPacketSize > 0 {
+		opts = append(opts, sftp.MaxPacketUnchecked(c.MaxPacketSize))
+	}
+	if c.Concurrency > 0 {
+		opts = append(opts, sftp.MaxConcurrentRequestsPerFile(c.Concurrency))
+	}
+	if c.ConcurrentWrites {
+		opts = append(opts, sftp.UseConcurrentWrites(true))
+	}
+	if c.DisableConcurrentReads {
+		opts = append(opts, sftp.UseConcurrentReads(false))
+	}
+	return opts
+}
+
+// session pairs an SFTP client with the SSH connection it runs over, so both
+// can be torn down together.
+type session struct {
+	conn   *ssh.Client
+	client *sftp.Client
+
+	// borrowed sessions run over a connection owned by the caller, which
+	// close leaves open
+	borrowed bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newSession(conn *ssh.Client, client *sftp.Client) *session {
+	return &session{conn: conn, client: client, done: make(chan struct{})}
+}
+
+func (s *session) close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.closeErr = s.client.Close()
+		if s.borrowed {
+			return
+		}
+		if err := s.conn.Close(); s.closeErr == nil {
+			s.closeErr = err
+		}
+	})
+	return s.closeErr
+}
+
+// closed reports whether s has been closed, by the keepalive or otherwise.
+func (s *session) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
 }
 
+// keepAlive pings the server every interval until the session is closed, and
+// closes it itself once maxMissed pings in a row fail or go unanswered.
+func (s *session) keepAlive(interval time.Duration, maxMissed int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			// Any reply, even a refusal, shows the peer is alive
+			_, _, err := s.conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-s.done:
+			return
+		case err := <-reply:
+			if err != nil {
+				missed++
+			} else {
+				missed = 0
+			}
+		case <-time.After(interval):
+			missed++
+		}
+
+		if missed >= maxMissed {
+			s.close()
+			return
+		}
+	}
+}
+
+// fileInfo describes an entry found by ListAllFiles. It implements
+// os.FileInfo, with Name holding the path relative to the listed directory.
 type fileInfo struct {
 	name    string
 	size    int64
 	mode    os.FileMode
 	modTime time.Time
 	isDir   bool
-	Sys     interface{}
+	sys     interface{}
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return fi.isDir }
+func (fi fileInfo) Sys() interface{}   { return fi.sys }
+
+// IsSymlink reports whether the entry is a symbolic link.
+func (fi fileInfo) IsSymlink() bool { return fi.mode&os.ModeSymlink != 0 }
+
+// IsRegular reports whether the entry is a regular file, as opposed to a
+// directory, symlink or special file.
+func (fi fileInfo) IsRegular() bool { return fi.mode.IsRegular() }
+
+// Perm returns the entry's Unix permission bits.
+func (fi fileInfo) Perm() os.FileMode { return fi.mode.Perm() }
+
+var _ os.FileInfo = fileInfo{}
+
+// connect dials a new session, retrying transient failures as the retry
+// policy allows.
+func (c *SFTPClient) connect(ctx context.Context) (*session, error) {
+	var s *session
+	err := c.connectPolicy().do(ctx, func() error {
+		var err error
+		s, err = c.connectOnce(ctx)
+		return err
+	})
+	if err != nil {
+		c.logger().Infof("connect to %s failed: %v", c.address(), err)
+		return nil, newConnectError(err)
+	}
+	c.logger().Debugf("connected to %s", c.address())
+	return s, nil
+}
+
+// connectPolicy returns the retry policy for connecting.
+func (c *SFTPClient) connectPolicy() RetryPolicy {
+	if c.ConnectRetries <= 0 {
+		return c.Retry
+	}
+	return RetryPolicy{
+		MaxAttempts: c.ConnectRetries + 1,
+		BaseDelay:   c.ConnectRetryDelay,
+		MaxDelay:    c.ConnectRetryDelay,
+	}
 }
 
-func (c *SFTPClient) connect() (*sftp.Client, error) {
+func (c *SFTPClient) connectOnce(ctx context.Context) (*session, error) {
+	if c.sshConn != nil {
+		return c.borrowSession()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+
+	conn, err := c.dialSSH(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open an SFTP client session, closing the connection if ctx is done
+	// while the subsystem is being negotiated
+	stop := watch(ctx, func() { conn.Close() })
+	client, err := sftp.NewClient(conn, c.sftpOptions()...)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		client.Close()
+		conn.Close()
+		return nil, ctx.Err()
+	}
+
+	return newSession(conn, client), nil
+}
+
+// clientConfig builds the SSH configuration from the client's credentials.
+// release must be called once the handshake is over.
+func (c *SFTPClient) clientConfig() (config *ssh.ClientConfig, release func(), err error) {
+	if c.SSHConfig != nil {
+		// Copy so that ConfigureSSH can't alter the caller's config
+		config := *c.SSHConfig
+		if c.ConfigureSSH != nil {
+			c.ConfigureSSH(&config)
+		}
+		return &config, func() {}, nil
+	}
+
+	auth, release, err := c.authMethods()
+	if err != nil {
+		return nil, nil, err
+	}
+	hostKeyCallback, err := c.hostKeyCallback()
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
 	// Set up SSH configuration
-	config := &ssh.ClientConfig{
+	config = &ssh.ClientConfig{
 		User: c.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(c.Password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth: auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout: c.dialTimeout(),
+	}
+	if c.ConfigureSSH != nil {
+		c.ConfigureSSH(config)
+	}
+	return config, release, nil
+}
+
+func (c *SFTPClient) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
+func (c *SFTPClient) dialTimeout() time.Duration {
+	if c.DialTimeout == 0 {
+		return c.timeout()
+	}
+	return c.DialTimeout
+}
+
+// dialSSH establishes an SSH connection to the server.
+func (c *SFTPClient) dialSSH(ctx context.Context) (*ssh.Client, error) {
+	config, release, err := c.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// The handshake only reports the callback's error as text, so note
+	// whether the host key was the problem
+	var hostKeyErr error
+	if verify := config.HostKeyCallback; verify != nil {
+		config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = verify(hostname, remote, key)
+			return hostKeyErr
+		}
+	}
+
+	addr := c.address()
+	netConn, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Closing the socket is the only way to interrupt the SSH handshake once
+	// it has started
+	stop := watch(ctx, func() { netConn.Close() })
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+	stop()
+	if err != nil {
+		netConn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if hostKeyErr != nil {
+			return nil, fmt.Errorf("%w: %v", ErrHostKey, err)
+		}
+		return nil, err
+	}
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// dial opens the transport to addr, tunnelled through JumpHost when one is
+// configured.
+func (c *SFTPClient) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if c.JumpHost == nil {
+		dialer := net.Dialer{Timeout: c.dialTimeout()}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	jump, err := c.JumpHost.dialSSH(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", c.JumpHost.address(), err)
+	}
+
+	stop := watch(ctx, func() { jump.Close() })
+	conn, err := jump.Dial("tcp", addr)
+	stop()
+	if err != nil {
+		jump.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("jump host %s: %w", c.JumpHost.address(), err)
+	}
+
+	return &tunnelConn{Conn: conn, jump: jump}, nil
+}
+
+// tunnelConn is a connection forwarded through a jump host. Closing it also
+// closes the connection to the jump host.
+type tunnelConn struct {
+	net.Conn
+	jump *ssh.Client
+}
+
+func (t *tunnelConn) Close() error {
+	err := t.Conn.Close()
+	t.jump.Close()
+	return err
+}
+
+// address returns the host:port to dial, with IPv6 literals bracketed.
+func (c *SFTPClient) address() string {
+	port := c.Port
+	if c.PortNumber != 0 {
+		port = strconv.Itoa(c.PortNumber)
+	}
+	if port == "" {
+		port = "22"
+	}
+
+	// Accept hosts that are already bracketed, e.g. "[fe80::1]"
+	host := strings.TrimSuffix(strings.TrimPrefix(c.IPAddress, "["), "]")
+	return net.JoinHostPort(host, port)
+}
+
+// watch calls fn if ctx is done before the returned stop func is called. Once
+// stop returns, fn is guaranteed not to run.
+func watch(ctx context.Context, fn func()) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			fn()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// Open establishes a connection that is reused by every subsequent call until
+// Close is called. Without Open, each call dials its own connection.
+//
+// If a call is cancelled or exceeds OperationTimeout while using the
+// connection, the connection is closed to interrupt it, failing any other
+// call in flight on it, and a new one is dialed in its place.
+//
+// Always call Close when done. A client dropped without it has its
+// connection closed once it is garbage collected, but that may be much
+// later, or never.
+func (c *SFTPClient) Open() error {
+	return c.open(context.Background())
+}
+
+func (c *SFTPClient) open(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.session != nil {
+		return nil
+	}
+	s, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	c.install(s)
+	return nil
+}
+
+// install makes s the shared session. c.mu must be held.
+func (c *SFTPClient) install(s *session) {
+	c.session = s
+	c.setGuard(newLeakGuard(s, c.address(), c.logger()))
+
+	if c.KeepAliveInterval > 0 {
+		maxMissed := c.KeepAliveMaxMissed
+		if maxMissed <= 0 {
+			maxMissed = 3
+		}
+		go s.keepAlive(c.KeepAliveInterval, maxMissed)
+	}
+}
+
+// replace swaps dead, if it is still the shared session, for a new
+// connection. Callers needing the session wait until the new one is up. If
+// dialing fails the client falls back to a connection per call.
+func (c *SFTPClient) replace(ctx context.Context, dead *session) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Closed, or already replaced by another caller
+	if c.session != dead {
+		return nil
+	}
+	dead.close()
+
+	s, err := c.connect(ctx)
+	if err != nil {
+		c.session = nil
+		c.setGuard(nil)
+		return err
+	}
+	c.install(s)
+	return nil
+}
+
+// abort closes s to interrupt a request whose context is done. Other calls
+// in flight on s fail too; if s is the shared session it is replaced so
+// that later calls keep sharing one connection.
+func (c *SFTPClient) abort(s *session) {
+	c.mu.Lock()
+	shared := s == c.session
+	c.mu.Unlock()
+
+	s.close()
+	if shared {
+		go c.replace(context.Background(), s)
+	}
+}
+
+// Client returns the sftp package client of the connection established by
+// Open, for features this package does not wrap. It fails with ErrNotOpen
+// when no connection is open. The client stays owned by c: do not close it,
+// and do not use it after Close.
+func (c *SFTPClient) Client() (*sftp.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.session == nil {
+		return nil, ErrNotOpen
+	}
+	return c.session.client, nil
+}
+
+// NewClientFromSSH returns a client that runs SFTP over conn, an SSH
+// connection the caller has already established, instead of dialing its own.
+// The SFTP session is started straight away. Closing the client, or any
+// failure, never closes conn; that stays up to the caller. The dial,
+// authentication and host key settings of the returned client are unused.
+func NewClientFromSSH(conn *ssh.Client) (*SFTPClient, error) {
+	c := &SFTPClient{sshConn: conn}
+	if host, port, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		c.IPAddress = host
+		c.Port = port
+	}
+
+	err := c.Open()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// borrowSession starts SFTP over the connection given to NewClientFromSSH.
+func (c *SFTPClient) borrowSession() (*session, error) {
+	client, err := sftp.NewClient(c.sshConn, c.sftpOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	s := newSession(c.sshConn, client)
+	s.borrowed = true
+	return s, nil
+}
+
+// leakGuard closes the connection established by Open if the client is
+// garbage collected without Close being called. It is only referenced by
+// the client, so it becomes unreachable together with it, while the session
+// itself stays reachable from its keepalive goroutine.
+type leakGuard struct {
+	s       *session
+	address string
+	log     Logger
+}
+
+func newLeakGuard(s *session, address string, log Logger) *leakGuard {
+	g := &leakGuard{s: s, address: address, log: log}
+	runtime.SetFinalizer(g, func(g *leakGuard) {
+		g.log.Infof("connection to %s was never closed, closing it", g.address)
+		g.s.close()
+	})
+	return g
+}
+
+// setGuard replaces the client's leak guard, disarming the old one. c.mu
+// must be held.
+func (c *SFTPClient) setGuard(g *leakGuard) {
+	if c.guard != nil {
+		runtime.SetFinalizer(c.guard, nil)
+	}
+	c.guard = g
+}
+
+// Close releases the connection established by Open. It is a no-op when no
+// connection is open.
+func (c *SFTPClient) Close() error {
+	c.mu.Lock()
+	s := c.session
+	c.session = nil
+	c.setGuard(nil)
+	c.mu.Unlock()
+
+	if s == nil {
+		return nil
+	}
+	c.logger().Debugf("closing connection to %s", c.address())
+	return s.close()
+}
+
+// acquire returns the session established by Open, or dials a new one.
+func (c *SFTPClient) acquire(ctx context.Context) (*session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	s := c.session
+	c.mu.Unlock()
+
+	if s != nil {
+		return s, nil
+	}
+	return c.connect(ctx)
+}
+
+// release closes s unless it is the session owned by Open.
+func (c *SFTPClient) release(s *session) {
+	c.mu.Lock()
+	cached := s == c.session
+	c.mu.Unlock()
+
+	if !cached {
+		c.logger().Debugf("closing connection to %s", c.address())
+		s.close()
+	}
+}
+
+// withClient runs fn against the open session, or against a one-off
+// connection that is torn down once fn returns. Errors are annotated with op
+// and path.
+func (c *SFTPClient) withClient(op, path string, fn func(client *sftp.Client) error) error {
+	return c.withClientContext(context.Background(), op, path, fn)
+}
+
+// withClientContext is like withClient but closes the connection as soon as
+// ctx is done, which unblocks any in-flight request, and reports ctx.Err().
+// The connection established by Open is replaced after being closed, but
+// other calls in flight on it fail.
+func (c *SFTPClient) withClientContext(ctx context.Context, op, path string, fn func(client *sftp.Client) error) error {
+	return c.withSession(ctx, op, path, false, fn)
+}
+
+// withSession implements withClientContext. If Reconnect is set and the
+// connection established by Open turns out to be dead, it is replaced, and
+// fn is run again on the new one if it is idempotent. Otherwise the error
+// is returned and only later calls use the new connection.
+func (c *SFTPClient) withSession(ctx context.Context, op, path string, idempotent bool, fn func(client *sftp.Client) error) (err error) {
+	done := c.trace(op, path)
+	defer func() { done(err) }()
+
+	s, err := c.acquire(ctx)
+	if err != nil {
+		return opError(op, path, err)
+	}
+	defer c.release(s)
+
+	if c.OperationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.OperationTimeout)
+		defer cancel()
+	}
+
+	err = c.run(ctx, s, fn)
+
+	if err != nil {
+		if s, ok := c.recover(ctx, s, err); ok {
+			defer c.release(s)
+			if idempotent {
+				err = c.run(ctx, s, fn)
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return opError(op, path, ctx.Err())
+	}
+	return opError(op, path, err)
+}
+
+// run calls fn on s, closing s if ctx is done first.
+func (c *SFTPClient) run(ctx context.Context, s *session, fn func(client *sftp.Client) error) error {
+	stop := watch(ctx, func() { c.abort(s) })
+	err := fn(s.client)
+	stop()
+	return err
+}
+
+// recover returns a live session in place of s, which a call failed on with
+// err, if Reconnect is set and err means the connection is gone. The caller
+// must release both sessions.
+func (c *SFTPClient) recover(ctx context.Context, s *session, err error) (*session, bool) {
+	if ctx.Err() != nil || !c.Reconnect || !isRetryable(err) {
+		return nil, false
+	}
+	return c.reopen(ctx, s)
+}
+
+// reopen replaces dead, the session established by Open, with a fresh one.
+// It reports false if Open is not in use or reconnecting failed.
+func (c *SFTPClient) reopen(ctx context.Context, dead *session) (*session, bool) {
+	c.mu.Lock()
+	current := c.session
+	c.mu.Unlock()
+	if current == nil {
+		return nil, false
+	}
+
+	if current == dead {
+		c.logger().Infof("connection to %s lost, reconnecting", c.address())
+		err := c.replace(ctx, dead)
+		if err != nil {
+			return nil, false
+		}
+	}
+	s, err := c.acquire(ctx)
+	if err != nil {
+		return nil, false
+	}
+	return s, true
+}
+
+// Ping checks that the server is reachable and accepts the credentials, using
+// the open connection if there is one. A rejected login is reported as
+// ErrAuth and an unreachable server as ErrConnect.
+func (c *SFTPClient) Ping() error {
+	return c.withClientContext(context.Background(), "ping", c.address(), func(client *sftp.Client) error {
+		_, err := client.Getwd()
+		return err
+	})
+}
+
+// resolve anchors a relative remote path at BasePath.
+func (c *SFTPClient) resolve(p string) string {
+	if c.BasePath == "" || path.IsAbs(p) {
+		return p
+	}
+	return path.Join(c.BasePath, p)
+}
+
+// Getwd returns the absolute directory relative paths are resolved against:
+// BasePath if set, otherwise the login directory.
+func (c *SFTPClient) Getwd() (string, error) {
+	if path.IsAbs(c.BasePath) {
+		return path.Clean(c.BasePath), nil
+	}
+
+	var wd string
+	err := c.withClientRetry(context.Background(), "getwd", c.BasePath, func(client *sftp.Client) error {
+		var err error
+		wd, err = client.Getwd()
+		if err != nil {
+			return err
+		}
+		wd = path.Join(wd, c.BasePath)
+		return nil
+	})
+	return wd, err
+}
+
+func (c *SFTPClient) AppendToFile(filePath string, data string) error {
+	return c.AppendToFileContext(context.Background(), filePath, data)
+}
+
+func (c *SFTPClient) AppendToFileContext(ctx context.Context, filePath string, data string) error {
+	return c.AppendBytesContext(ctx, filePath, []byte(data))
+}
+
+// AppendBytes is like AppendToFile for binary data.
+func (c *SFTPClient) AppendBytes(filePath string, data []byte) error {
+	return c.AppendBytesContext(context.Background(), filePath, data)
+}
+
+func (c *SFTPClient) AppendBytesContext(ctx context.Context, filePath string, data []byte) error {
+	filePath = c.resolve(filePath)
+	if c.dryRun("append", filePath) {
+		return nil
+	}
+	return c.withClientContext(ctx, "append", filePath, func(client *sftp.Client) error {
+		return appendBytes(client, filePath, data)
+	})
+}
+
+func appendBytes(client *sftp.Client, filePath string, data []byte) error {
+	// Check if the file exists
+	_, err := client.Stat(filePath)
+	if err == nil {
+		// File exists, append to it
+		f, err := client.OpenFile(filePath, os.O_APPEND|os.O_WRONLY)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = f.Write(data)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// File does not exist, create it
+	f, err := client.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AppendLine appends line to filePath, adding a trailing newline unless line
+// already ends with one. The file is created if it does not exist.
+func (c *SFTPClient) AppendLine(filePath string, line string) error {
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	return c.AppendToFile(filePath, line)
+}
+
+func (c *SFTPClient) OverwriteFile(filePath string, data string) error {
+	return c.OverwriteFileContext(context.Background(), filePath, data)
+}
+
+func (c *SFTPClient) OverwriteFileContext(ctx context.Context, filePath string, data string) error {
+	return c.OverwriteBytesContext(ctx, filePath, []byte(data))
+}
+
+// OverwriteBytes is like OverwriteFile for binary data.
+func (c *SFTPClient) OverwriteBytes(filePath string, data []byte) error {
+	return c.OverwriteBytesContext(context.Background(), filePath, data)
+}
+
+func (c *SFTPClient) OverwriteBytesContext(ctx context.Context, filePath string, data []byte) error {
+	filePath = c.resolve(filePath)
+	if c.dryRun("overwrite", filePath) {
+		return nil
+	}
+	return c.withClientContext(ctx, "overwrite", filePath, func(client *sftp.Client) error {
+		return overwriteBytes(client, filePath, data)
+	})
+}
+
+func overwriteBytes(client *sftp.Client, filePath string, data []byte) error {
+	// Overwrite the file
+	f, err := client.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// OverwriteFileWithMode is OverwriteFile giving the file the permissions in
+// mode. They are applied through the open handle before any data is written,
+// so the content is never readable under the server's default permissions.
+func (c *SFTPClient) OverwriteFileWithMode(filePath string, data string, mode os.FileMode) error {
+	filePath = c.resolve(filePath)
+	if c.dryRun("overwrite", filePath) {
+		return nil
+	}
+	return c.withClient("overwrite", filePath, func(client *sftp.Client) error {
+		f, err := client.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+
+		err = f.Chmod(mode)
+		if err == nil {
+			_, err = f.Write([]byte(data))
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+}
+
+// CreateExclusive creates filePath with data, failing with an error
+// satisfying errors.Is(err, os.ErrExist) if it already exists. The check and
+// the create are a single atomic step on the server, which makes it suitable
+// for lock files.
+func (c *SFTPClient) CreateExclusive(filePath string, data []byte) error {
+	filePath = c.resolve(filePath)
+	if c.dryRun("create", filePath) {
+		return nil
 	}
+	return c.withClient("create", filePath, func(client *sftp.Client) error {
+		f, err := client.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			// Servers report an existing file as a generic failure
+			if _, serr := client.Lstat(filePath); serr == nil {
+				return &os.PathError{Op: "create", Path: filePath, Err: os.ErrExist}
+			}
+			return err
+		}
+
+		_, err = f.Write(data)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+}
+
+// AtomicOverwriteFile replaces filePath with data so that readers see either
+// the old or the new content, never a partial write. The data goes to a
+// sibling temp file with a random name, which is renamed over filePath once
+// fully written.
+func (c *SFTPClient) AtomicOverwriteFile(filePath string, data string) error {
+	filePath = c.resolve(filePath)
+	if c.dryRun("overwrite", filePath) {
+		return nil
+	}
+	return c.withClient("overwrite", filePath, func(client *sftp.Client) error {
+		tmpPath, err := tempName(filePath)
+		if err != nil {
+			return err
+		}
+		// O_EXCL so that a concurrent writer can never share the temp file
+		f, err := client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			return err
+		}
+
+		err = writeAndSync(client, f, []byte(data))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = renameOverwrite(client, tmpPath, filePath)
+		}
+		if err != nil {
+			// Don't leave the temp file behind
+			client.Remove(tmpPath)
+			return err
+		}
+
+		return nil
+	})
+}
+
+// tempName returns a name for a temp file next to p, unique to this call.
+func tempName(p string) (string, error) {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+	return p + "." + hex.EncodeToString(b[:]) + ".tmp", nil
+}
+
+// writeAndSync writes data to f and flushes it to disk when the server
+// supports fsync@openssh.com.
+func writeAndSync(client *sftp.Client, f *sftp.File, data []byte) error {
+	_, err := f.Write(data)
+	if err != nil {
+		return err
+	}
+	if _, ok := client.HasExtension("fsync@openssh.com"); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+// Stat returns file information for filePath, following symlinks.
+func (c *SFTPClient) Stat(filePath string) (os.FileInfo, error) {
+	filePath = c.resolve(filePath)
+	var info os.FileInfo
+	err := c.withClientRetry(context.Background(), "stat", filePath, func(client *sftp.Client) error {
+		var err error
+		info, err = client.Stat(filePath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Lstat is like Stat but describes a symlink itself rather than its target.
+func (c *SFTPClient) Lstat(filePath string) (os.FileInfo, error) {
+	filePath = c.resolve(filePath)
+	var info os.FileInfo
+	err := c.withClientRetry(context.Background(), "lstat", filePath, func(client *sftp.Client) error {
+		var err error
+		info, err = client.Lstat(filePath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Chmod changes the permissions of filePath.
+func (c *SFTPClient) Chmod(filePath string, mode os.FileMode) error {
+	filePath = c.resolve(filePath)
+	if c.dryRun("chmod", filePath) {
+		return nil
+	}
+	return c.withClient("chmod", filePath, func(client *sftp.Client) error {
+		return client.Chmod(filePath, mode)
+	})
+}
+
+// Chown changes the numeric owner and group of filePath. Servers usually only
+// allow this for privileged users; their permission error is returned as is.
+func (c *SFTPClient) Chown(filePath string, uid, gid int) error {
+	filePath = c.resolve(filePath)
+	if c.dryRun("chown", filePath) {
+		return nil
+	}
+	return c.withClient("chown", filePath, func(client *sftp.Client) error {
+		return client.Chown(filePath, uid, gid)
+	})
+}
+
+// SetModTime sets the modification time of filePath. SFTP sets both times at
+// once, so the access time is set to mtime as well.
+func (c *SFTPClient) SetModTime(filePath string, mtime time.Time) error {
+	filePath = c.resolve(filePath)
+	if c.dryRun("chtimes", filePath) {
+		return nil
+	}
+	return c.withClient("chtimes", filePath, func(client *sftp.Client) error {
+		return client.Chtimes(filePath, mtime, mtime)
+	})
+}
+
+// Symlink creates linkPath as a symbolic link to target. It fails with an
+// error satisfying errors.Is(err, os.ErrExist) if linkPath already exists.
+func (c *SFTPClient) Symlink(target, linkPath string) error {
+	linkPath = c.resolve(linkPath)
+	if c.dryRun("symlink", linkPath) {
+		return nil
+	}
+	return c.withClient("symlink", linkPath, func(client *sftp.Client) error {
+		// Servers report an existing link path as a generic failure
+		_, err := client.Lstat(linkPath)
+		if err == nil {
+			return &os.PathError{Op: "symlink", Path: linkPath, Err: os.ErrExist}
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return client.Symlink(target, linkPath)
+	})
+}
+
+// ReadLink returns the target of the symbolic link linkPath.
+func (c *SFTPClient) ReadLink(linkPath string) (string, error) {
+	linkPath = c.resolve(linkPath)
+	var target string
+	err := c.withClient("readlink", linkPath, func(client *sftp.Client) error {
+		var err error
+		target, err = client.ReadLink(linkPath)
+		return err
+	})
+	return target, err
+}
+
+// Truncate changes the size of filePath. Truncating to a larger size extends
+// the file with zero bytes on POSIX servers.
+func (c *SFTPClient) Truncate(filePath string, size int64) error {
+	filePath = c.resolve(filePath)
+	if c.dryRun("truncate", filePath) {
+		return nil
+	}
+	return c.withClient("truncate", filePath, func(client *sftp.Client) error {
+		return client.Truncate(filePath, size)
+	})
+}
+
+// FreeSpace reports the size of the filesystem holding filePath and the space
+// on it available to unprivileged users, in bytes. It needs the
+// statvfs@openssh.com extension and returns ErrUnsupported without it.
+func (c *SFTPClient) FreeSpace(filePath string) (total, free uint64, err error) {
+	filePath = c.resolve(filePath)
+	err = c.withClient("statvfs", filePath, func(client *sftp.Client) error {
+		if _, ok := client.HasExtension("statvfs@openssh.com"); !ok {
+			return ErrUnsupported
+		}
+
+		stat, err := client.StatVFS(filePath)
+		if err != nil {
+			return err
+		}
+		total = stat.TotalSpace()
+		free = stat.Frsize * stat.Bavail
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return total, free, nil
+}
+
+// Exists reports whether filePath exists. Errors other than the path not
+// existing, such as permission denied, are returned rather than reported as
+// false.
+func (c *SFTPClient) Exists(filePath string) (bool, error) {
+	filePath = c.resolve(filePath)
+	var exists bool
+	err := c.withClientRetry(context.Background(), "stat", filePath, func(client *sftp.Client) error {
+		_, err := client.Stat(filePath)
+		if err == nil {
+			exists = true
+			return nil
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+	return exists, err
+}
+
+// IsDir reports whether filePath is a directory, following symlinks. If it
+// does not exist the returned error satisfies errors.Is(err, ErrNotFound).
+func (c *SFTPClient) IsDir(filePath string) (bool, error) {
+	info, err := c.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+// IsEmptyDir reports whether dirPath is a directory with no entries. It
+// fails if dirPath is not a directory.
+func (c *SFTPClient) IsEmptyDir(dirPath string) (bool, error) {
+	dirPath = c.resolve(dirPath)
+	var empty bool
+	err := c.withClientRetry(context.Background(), "readdir", dirPath, func(client *sftp.Client) error {
+		info, err := client.Stat(dirPath)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dirPath)
+		}
+
+		files, err := client.ReadDir(dirPath)
+		if err != nil {
+			return err
+		}
+		empty = len(files) == 0
+		return nil
+	})
+	return empty, err
+}
+
+// DeleteFile removes a remote file. If it does not exist the returned error
+// satisfies errors.Is(err, os.ErrNotExist).
+func (c *SFTPClient) DeleteFile(filePath string) error {
+	filePath = c.resolve(filePath)
+	if c.dryRun("remove", filePath) {
+		return nil
+	}
+	return c.withClient("remove", filePath, func(client *sftp.Client) error {
+		return client.Remove(filePath)
+	})
+}
+
+// DeleteFileIfExists is like DeleteFile but treats a missing file as success.
+func (c *SFTPClient) DeleteFileIfExists(filePath string) error {
+	err := c.DeleteFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Rename moves oldPath to newPath. It fails if newPath already exists; use
+// RenameOverwrite to replace it.
+func (c *SFTPClient) Rename(oldPath, newPath string) error {
+	oldPath = c.resolve(oldPath)
+	newPath = c.resolve(newPath)
+	if c.dryRun("rename", oldPath+" to "+newPath) {
+		return nil
+	}
+	return c.withClient("rename", oldPath, func(client *sftp.Client) error {
+		return client.Rename(oldPath, newPath)
+	})
+}
+
+// RenameOverwrite moves oldPath to newPath, replacing newPath if it exists.
+// The replacement is atomic when the server supports posix-rename@openssh.com;
+// otherwise newPath is removed first, leaving a short window where neither
+// name exists.
+func (c *SFTPClient) RenameOverwrite(oldPath, newPath string) error {
+	oldPath = c.resolve(oldPath)
+	newPath = c.resolve(newPath)
+	if c.dryRun("rename", oldPath+" to "+newPath) {
+		return nil
+	}
+	return c.withClient("rename", oldPath, func(client *sftp.Client) error {
+		return renameOverwrite(client, oldPath, newPath)
+	})
+}
+
+func renameOverwrite(client *sftp.Client, oldPath, newPath string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldPath, newPath)
+	}
+
+	err := client.Remove(newPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return client.Rename(oldPath, newPath)
+}
+
+// ReadFile returns the whole content of filePath. FIFOs, devices and other
+// special files are refused with ErrNotRegular rather than read.
+func (c *SFTPClient) ReadFile(filePath string) ([]byte, error) {
+	return c.ReadFileContext(context.Background(), filePath)
+}
+
+func (c *SFTPClient) ReadFileContext(ctx context.Context, filePath string) ([]byte, error) {
+	return c.readFile(ctx, filePath, c.MaxReadSize)
+}
+
+// ReadFileLimit is like ReadFile but fails with ErrFileTooLarge, without
+// reading anything, if filePath is larger than limit bytes.
+func (c *SFTPClient) ReadFileLimit(filePath string, limit int64) ([]byte, error) {
+	return c.readFile(context.Background(), filePath, limit)
+}
+
+// readFile reads filePath whole, refusing files over limit bytes unless
+// limit is zero.
+func (c *SFTPClient) readFile(ctx context.Context, filePath string, limit int64) ([]byte, error) {
+	filePath = c.resolve(filePath)
+	var data []byte
+	err := c.withClientRetry(ctx, "read", filePath, func(client *sftp.Client) error {
+		info, err := statRegular(client, filePath)
+		if err != nil {
+			return err
+		}
+
+		// Open the file for reading
+		f, err := client.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var r io.Reader = f
+		if limit > 0 {
+			if info.Size() > limit {
+				return fmt.Errorf("%w: %d bytes, limit is %d", ErrFileTooLarge, info.Size(), limit)
+			}
+			// The file may still grow while it is read
+			r = io.LimitReader(f, limit+1)
+		}
+
+		// Read all the lines in the file
+		buf := new(bytes.Buffer)
+		_, err = buf.ReadFrom(r)
+		if err != nil {
+			return err
+		}
+		if limit > 0 && int64(buf.Len()) > limit {
+			return fmt.Errorf("%w: limit is %d bytes", ErrFileTooLarge, limit)
+		}
 
-	// Connect to the SFTP server
-	conn, err := ssh.Dial("tcp", c.IPAddress + ":" + c.Port, config)
+		data = buf.Bytes()
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return data, nil
+}
 
-	// Open an SFTP client session
-	client, err := sftp.NewClient(conn)
+// statRegular stats filePath and fails with ErrNotRegular unless it is a
+// regular file. Opening a FIFO or device for reading could block forever.
+func statRegular(client *sftp.Client, filePath string) (os.FileInfo, error) {
+	info, err := client.Stat(filePath)
 	if err != nil {
 		return nil, err
 	}
-
-	return client, nil
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: mode %s", ErrNotRegular, info.Mode())
+	}
+	return info, nil
 }
 
-func (c *SFTPClient) AppendToFile(filePath string, data string) error {
-	client, err := c.connect()
+// ReadFileString is like ReadFile but returns the content as a string.
+func (c *SFTPClient) ReadFileString(filePath string) (string, error) {
+	data, err := c.ReadFile(filePath)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer client.Close()
+	return string(data), nil
+}
 
-	// Check if the file exists
-	_, err = client.Stat(filePath)
-	if err == nil {
-		// File exists, append to it
-		f, err := client.OpenFile(filePath, os.O_APPEND|os.O_WRONLY)
+// ReadFileRange reads up to length bytes of filePath starting at offset. Fewer
+// bytes are returned if the file ends first, and an offset past the end
+// yields an empty slice and no error.
+func (c *SFTPClient) ReadFileRange(filePath string, offset, length int64) ([]byte, error) {
+	filePath = c.resolve(filePath)
+	var data []byte
+	err := c.withClientRetry(context.Background(), "read", filePath, func(client *sftp.Client) error {
+		_, err := statRegular(client, filePath)
+		if err != nil {
+			return err
+		}
+
+		f, err := client.Open(filePath)
 		if err != nil {
 			return err
 		}
 		defer f.Close()
 
-		_, err = f.Write([]byte(data))
+		_, err = f.Seek(offset, io.SeekStart)
 		if err != nil {
 			return err
 		}
-		return nil
-	}
 
-	// File does not exist, create it
-	f, err := client.Create(filePath)
-	if err != nil {
+		data, err = io.ReadAll(io.LimitReader(f, length))
 		return err
-	}
-	defer f.Close()
-
-	_, err = f.Write([]byte(data))
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return data, nil
+}
 
-	return nil
+// Head reads at most the first n bytes of filePath, without fetching the
+// rest of the file.
+func (c *SFTPClient) Head(filePath string, n int64) ([]byte, error) {
+	return c.ReadFileRange(filePath, 0, n)
 }
 
-func (c *SFTPClient) OverwriteFile(filePath string, data string) error {
-	client, err := c.connect()
-	if err != nil {
+func (c *SFTPClient) ListOfFilesDir(dirPath string) ([]os.FileInfo, error) {
+	dirPath = c.resolve(dirPath)
+	var files []os.FileInfo
+	err := c.withClientRetry(context.Background(), "readdir", dirPath, func(client *sftp.Client) error {
+		// List the files and directories in the specified directory
+		var err error
+		files, err = client.ReadDir(dirPath)
 		return err
-	}
-	defer client.Close()
-
-	// Overwrite the file
-	f, err := client.Create(filePath)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
+	return files, nil
+}
+
+// SortOrder selects how ListOfFilesDirSorted orders its entries.
+type SortOrder int
+
+const (
+	// SortByName orders entries by name, byte-wise.
+	SortByName SortOrder = iota
+
+	// SortByModTime orders entries from oldest to newest, by name where
+	// the modification times are equal.
+	SortByModTime
+)
 
-	_, err = f.Write([]byte(data))
+// ListOfFilesDirSorted is ListOfFilesDir with the entries in a deterministic
+// order rather than the order the server returns them in.
+func (c *SFTPClient) ListOfFilesDirSorted(dirPath string, order SortOrder) ([]os.FileInfo, error) {
+	files, err := c.ListOfFilesDir(dirPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	sort.Slice(files, func(i, j int) bool {
+		if order == SortByModTime && !files[i].ModTime().Equal(files[j].ModTime()) {
+			return files[i].ModTime().Before(files[j].ModTime())
+		}
+		return files[i].Name() < files[j].Name()
+	})
+	return files, nil
 }
 
-func (c *SFTPClient) ReadFile(filePath string) ([]byte, error) {
-	client, err := c.connect()
+// ListDirectories returns the names of the subdirectories of dirPath.
+// Symlinks to directories are not included.
+func (c *SFTPClient) ListDirectories(dirPath string) ([]string, error) {
+	files, err := c.ListOfFilesDir(dirPath)
 	if err != nil {
 		return nil, err
 	}
-	defer client.Close()
 
-	// Open the file for reading
-	f, err := client.Open(filePath)
-	if err != nil {
-		return nil, err
+	var dirs []string
+	for _, f := range files {
+		if f.IsDir() {
+			dirs = append(dirs, f.Name())
+		}
 	}
-	defer f.Close()
+	return dirs, nil
+}
 
-	// Read all the lines in the file
-	buf := new(bytes.Buffer)
-	_, err = buf.ReadFrom(f)
+// ListAllDirectories returns every directory below dirPath, named by its
+// path relative to dirPath, such as "sub/deeper". Symlinks are not followed.
+func (c *SFTPClient) ListAllDirectories(dirPath string) ([]string, error) {
+	// Walk resolves dirPath itself and joins every path onto the result
+	dirPath = path.Clean(dirPath)
+	root := c.resolve(dirPath)
+	var dirs []string
+	err := c.Walk(dirPath, func(dir string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && dir != root {
+			dirs = append(dirs, relPath(root, dir))
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return dirs, nil
+}
+
+// ListOptions controls how ListAllFilesWithOptions walks a directory tree.
+// The zero value lists symlinks as plain entries without following them.
+type ListOptions struct {
+	// FollowSymlinks descends into symlinked directories. Each directory is
+	// visited at most once, so a link pointing back up the tree cannot loop.
+	FollowSymlinks bool
+
+	// SkipSymlinks leaves symlinks out of the results entirely.
+	SkipSymlinks bool
+
+	// MaxDepth limits how many levels of subdirectories are descended into.
+	// Depth 0 lists the directory itself only. Nil means no limit.
+	MaxDepth *int
+
+	// ContinueOnError keeps walking past directories that cannot be read.
+	// The entries gathered are returned along with a *ListError naming every
+	// directory that failed.
+	ContinueOnError bool
+
+	// Concurrency is how many directories are listed at once, over the same
+	// connection. Values above 1 speed up wide trees on high-latency links,
+	// at the cost of returning entries in no particular order.
+	Concurrency int
+
+	// SkipHidden leaves out files and directories whose name starts with a
+	// dot, and does not descend into hidden directories.
+	SkipHidden bool
 
-	return buf.Bytes(), nil
+	// SkipSpecial leaves out FIFOs, sockets, device nodes and other entries
+	// that are neither regular files, directories nor symlinks.
+	SkipSpecial bool
+
+	// Filter, if set, is called for every file and only those it returns
+	// true for are listed. Its argument carries the file's base name.
+	Filter func(info os.FileInfo) bool
+
+	// Descend, if set, is called for every directory and the walk only
+	// descends into those it returns true for. With Concurrency above 1,
+	// Filter and Descend may be called from several goroutines at once.
+	Descend func(info os.FileInfo) bool
+
+	// AbsolutePaths names the files by their full path on the server, with
+	// relative roots resolved against the login directory. By default names
+	// are relative to the listed directory, like "a.txt" or "sub/b.txt".
+	AbsolutePaths bool
 }
 
-func (c *SFTPClient) ListOfFilesDir(dirPath string) ([]os.FileInfo, error) {
-	client, err := c.connect()
-	if err != nil {
-		return nil, err
+// ListError collects the directories that could not be read during a listing
+// with ListOptions.ContinueOnError set.
+type ListError struct {
+	Errors []*os.PathError
+}
+
+func (e *ListError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
 	}
-	defer client.Close()
+	return fmt.Sprintf("%d directories could not be listed: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
 
-	// List the files and directories in the specified directory
-	files,	err := client.ReadDir(dirPath)
-	if err != nil {
-		return nil, err
+func (e *ListError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
 	}
-	return files, nil
+	return errs
 }
 
+// ListAllFiles returns every file below dirPath, named by its path relative
+// to dirPath, such as "sub/b.txt".
+// Hidden files and directories are included; use ListAllFilesWithOptions
+// with SkipHidden to leave them out.
 func (c *SFTPClient) ListAllFiles(dirPath string) ([]fileInfo, error) {
-	client, err := c.connect()
-	if err != nil {
-		return nil, err
-	}
-	defer client.Close()
+	return c.ListAllFilesWithOptions(dirPath, ListOptions{})
+}
 
+func (c *SFTPClient) ListAllFilesWithOptions(dirPath string, opts ListOptions) ([]fileInfo, error) {
+	dirPath = c.resolve(dirPath)
 	// Recursively list all files and directories in the specified directory
 	var allFiles []fileInfo
-	err = c.listAllFilesRecursive(dirPath, "", client, &allFiles)
+	err := c.withClientRetry(context.Background(), "list", dirPath, func(client *sftp.Client) error {
+		var err error
+		allFiles, err = newLister(client, opts).list(dirPath)
+		return err
+	})
 	if err != nil {
+		var listErr *ListError
+		if errors.As(err, &listErr) {
+			return allFiles, err
+		}
 		return nil, err
 	}
 
 	return allFiles, nil
 }
 
-func (c *SFTPClient) listAllFilesRecursive(dirPath string, prefix string, client *sftp.Client, allFiles *[]fileInfo) error {
-    files, err := client.ReadDir(dirPath)
-    if err != nil {
-        return err
-    }
-    for _, f := range files {
-        if f.IsDir() {
-            newPrefix := prefix + "/" + f.Name()
-            err := c.listAllFilesRecursive(dirPath + "/" + f.Name(), newPrefix, client, allFiles)
-            if err != nil {
-                return err
-            }
-        } else {
-			// Create a new FileInfo struct with the updated Name field
-			newFile := &fileInfo{
-				name:    prefix + "/" + f.Name(),
-				size:    f.Size(),
-				mode:    f.Mode(),
-				modTime: f.ModTime(),
-				isDir:   f.IsDir(),
-				Sys: f.Sys(),
-			}
-			// Add the new FileInfo to the allFiles slice
-			*allFiles = append(*allFiles, *newFile)
-        }
-    }
+// CountFiles returns the number of files below dirPath, counting everything
+// that is not a directory. It is cheaper than ListAllFiles when only the
+// count is needed.
+func (c *SFTPClient) CountFiles(dirPath string) (int, error) {
+	return c.CountFilesWithOptions(dirPath, ListOptions{})
+}
 
-    return nil
+// CountFilesWithOptions is CountFiles with the same options as
+// ListAllFilesWithOptions, for example SkipHidden to leave out dotfiles.
+func (c *SFTPClient) CountFilesWithOptions(dirPath string, opts ListOptions) (int, error) {
+	dirPath = c.resolve(dirPath)
+	var n int
+	err := c.withClientRetry(context.Background(), "count", dirPath, func(client *sftp.Client) error {
+		var err error
+		n, err = newLister(client, opts).count(dirPath)
+		return err
+	})
+	return n, err
 }
 
-func (c *SFTPClient) CreateDirectoryIfNotExist(dirPath string) error {
-	client, err := c.connect()
+// lister holds the state of a single recursive listing.
+type lister struct {
+	client *sftp.Client
+	opts   ListOptions
+
+	// found is called for every file, with mu held
+	found func(f fileInfo)
+
+	// sem limits the extra goroutines of a concurrent listing
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu      sync.Mutex
+	visited map[string]bool
+	errs    []*os.PathError
+	err     error
+}
+
+func newLister(client *sftp.Client, opts ListOptions) *lister {
+	l := &lister{client: client, opts: opts, visited: make(map[string]bool)}
+	if opts.Concurrency > 1 {
+		// The calling goroutine is one of the workers
+		l.sem = make(chan struct{}, opts.Concurrency-1)
+	}
+	return l
+}
+
+// list returns the files below dirPath. With ContinueOnError set, the files
+// are returned even if some directories failed, along with a *ListError.
+func (l *lister) list(dirPath string) ([]fileInfo, error) {
+	var allFiles []fileInfo
+	l.found = func(f fileInfo) { allFiles = append(allFiles, f) }
+	err := l.run(dirPath)
+	if err != nil && len(l.errs) == 0 {
+		return nil, err
+	}
+	return allFiles, err
+}
+
+// count is like list but only counts the files.
+func (l *lister) count(dirPath string) (int, error) {
+	var n int
+	l.found = func(fileInfo) { n++ }
+	return n, l.run(dirPath)
+}
+
+// run walks dirPath, passing every file to l.found.
+func (l *lister) run(dirPath string) error {
+	prefix := ""
+	if l.opts.AbsolutePaths {
+		prefix = dirPath
+		if !path.IsAbs(prefix) {
+			wd, err := l.client.Getwd()
+			if err != nil {
+				return err
+			}
+			prefix = path.Join(wd, prefix)
+		}
+	}
+
+	err := l.listAllFilesRecursive(dirPath, prefix, 0)
+	l.wg.Wait()
+	if err == nil {
+		err = l.err
+	}
 	if err != nil {
 		return err
 	}
-	defer client.Close()
 
-	_, err = client.Stat(dirPath)
-	if err == nil {
-		// Directory already exists, nothing to do
+	if len(l.errs) > 0 {
+		return &ListError{Errors: l.errs}
+	}
+	return nil
+}
+
+// skip records err against dirPath and reports whether the walk should carry
+// on past it.
+func (l *lister) skip(op, dirPath string, err error) bool {
+	if !l.opts.ContinueOnError {
+		return false
+	}
+	l.mu.Lock()
+	l.errs = append(l.errs, &os.PathError{Op: op, Path: dirPath, Err: err})
+	l.mu.Unlock()
+	return true
+}
+
+// fail records the first error hit by a concurrent worker.
+func (l *lister) fail(err error) {
+	l.mu.Lock()
+	if l.err == nil {
+		l.err = err
+	}
+	l.mu.Unlock()
+}
+
+func (l *lister) failed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err != nil
+}
+
+// firstVisit marks realPath as visited and reports whether it was new.
+func (l *lister) firstVisit(realPath string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.visited[realPath] {
+		return false
+	}
+	l.visited[realPath] = true
+	return true
+}
+
+// realPath resolves p to an absolute path free of symlinks. The server's
+// realpath is not enough: some servers, pkg/sftp's own among them, make the
+// path absolute without resolving links.
+func (l *lister) realPath(p string) (string, error) {
+	abs, err := l.client.RealPath(p)
+	if err != nil {
+		return "", err
+	}
+
+	resolved := "/"
+	rest := strings.Split(abs, "/")
+	for links := 0; len(rest) > 0; {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, name)
+		info, err := l.client.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > 40 {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", p)
+		}
+		target, err := l.client.ReadLink(next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return resolved, nil
+}
+
+func (l *lister) listAllFilesRecursive(dirPath string, prefix string, depth int) error {
+	if l.failed() {
+		// Another worker has already failed the listing
 		return nil
 	}
 
-	// Directory does not exist, create it
-	err = client.Mkdir(dirPath)
+	if l.opts.FollowSymlinks {
+		// Resolve the directory so that every route to it, direct or via a
+		// link, is recognised as the same place
+		realPath, err := l.realPath(dirPath)
+		if err != nil {
+			if l.skip("realpath", dirPath, err) {
+				return nil
+			}
+			return err
+		}
+		if !l.firstVisit(realPath) {
+			return nil
+		}
+	}
+
+	files, err := l.client.ReadDir(dirPath)
 	if err != nil {
+		if l.skip("readdir", dirPath, err) {
+			return nil
+		}
 		return err
 	}
+	for _, f := range files {
+		if l.opts.SkipHidden && strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			if l.opts.SkipSymlinks {
+				continue
+			}
+			if l.opts.FollowSymlinks {
+				// Broken links are kept as they are
+				if target, err := l.client.Stat(path.Join(dirPath, f.Name())); err == nil {
+					f = target
+				}
+			}
+		}
+		if l.opts.SkipSpecial && f.Mode()&(os.ModeType&^(os.ModeDir|os.ModeSymlink)) != 0 {
+			continue
+		}
+
+		if f.IsDir() {
+			if l.opts.MaxDepth != nil && depth >= *l.opts.MaxDepth {
+				continue
+			}
+			if l.opts.Descend != nil && !l.opts.Descend(f) {
+				continue
+			}
+			newPrefix := path.Join(prefix, f.Name())
+			subDir := path.Join(dirPath, f.Name())
+			// Hand the subdirectory to another goroutine if one is free,
+			// otherwise list it here
+			select {
+			case l.sem <- struct{}{}:
+				l.wg.Add(1)
+				go func() {
+					defer l.wg.Done()
+					defer func() { <-l.sem }()
+					err := l.listAllFilesRecursive(subDir, newPrefix, depth+1)
+					if err != nil {
+						l.fail(err)
+					}
+				}()
+				continue
+			default:
+			}
+			err := l.listAllFilesRecursive(subDir, newPrefix, depth+1)
+			if err != nil {
+				return err
+			}
+		} else {
+			if l.opts.Filter != nil && !l.opts.Filter(f) {
+				continue
+			}
+			// Create a new FileInfo struct with the updated Name field
+			newFile := &fileInfo{
+				name:    path.Join(prefix, f.Name()),
+				size:    f.Size(),
+				mode:    f.Mode(),
+				modTime: f.ModTime(),
+				isDir:   f.IsDir(),
+				sys:     f.Sys(),
+			}
+			l.mu.Lock()
+			l.found(*newFile)
+			l.mu.Unlock()
+		}
+	}
 
 	return nil
 }
 
+func (c *SFTPClient) CreateDirectoryIfNotExist(dirPath string) error {
+	dirPath = c.resolve(dirPath)
+	if c.dryRun("mkdir", dirPath) {
+		return nil
+	}
+	return c.withClient("mkdir", dirPath, func(client *sftp.Client) error {
+		info, err := client.Stat(dirPath)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dirPath)
+			}
+			// Directory already exists, nothing to do
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		// Directory does not exist, create it
+		err = client.Mkdir(dirPath)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+}
+
 func (c *SFTPClient) CreateDirectoryRecursively(dirPath string) error {
-	client, err := c.connect()
-	if err != nil {
-		return err
+	dirPath = c.resolve(dirPath)
+	if c.dryRun("mkdir", dirPath) {
+		return nil
 	}
-	defer client.Close()
+	return c.withClient("mkdir", dirPath, func(client *sftp.Client) error {
+		return createDirectoryRecursive(client, dirPath)
+	})
+}
 
+func createDirectoryRecursive(client *sftp.Client, dirPath string) error {
 	// Split the directory path into individual components
 	pathComponents := strings.Split(dirPath, "/")
 
 	// Iterate through each path component and create the directories as needed
-	currentPath := ""
+	currentPath := "/"
 	for _, component := range pathComponents {
 		if component == "" {
 			// Skip empty path components (e.g. from leading/trailing slashes)
 			continue
 		}
-		currentPath += "/" + component
-		_, err := client.Stat(currentPath)
+		currentPath = path.Join(currentPath, component)
+		info, err := client.Stat(currentPath)
 		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", currentPath)
+			}
 			// Directory already exists, nothing to do
 			continue
 		}
+		// Only a missing directory is created, other failures such as a
+		// permission error are reported
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
 		err = client.Mkdir(currentPath)
 		if err != nil {
 			return err
@@ -250,3 +1973,99 @@ func (c *SFTPClient) CreateDirectoryRecursively(dirPath string) error {
 	}
 	return nil
 }
+
+// MkdirAll creates dirPath along with any missing parents, giving each
+// directory it creates the permissions in mode. Existing directories are left
+// as they are. Relative paths are created below the login directory.
+func (c *SFTPClient) MkdirAll(dirPath string, mode os.FileMode) error {
+	dirPath = c.resolve(dirPath)
+	if c.dryRun("mkdir", dirPath) {
+		return nil
+	}
+	return c.withClient("mkdir", dirPath, func(client *sftp.Client) error {
+		return mkdirAll(client, dirPath, mode)
+	})
+}
+
+func mkdirAll(client *sftp.Client, dirPath string, mode os.FileMode) error {
+	current := ""
+	if path.IsAbs(dirPath) {
+		current = "/"
+	}
+	for _, component := range strings.Split(dirPath, "/") {
+		if component == "" {
+			continue
+		}
+		current = path.Join(current, component)
+
+		info, err := client.Stat(current)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", current)
+			}
+			continue
+		}
+		// Anything but a missing directory, such as permission denied, is
+		// a real failure
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		err = client.Mkdir(current)
+		if err != nil {
+			// Someone else may have created it in the meantime
+			if info, serr := client.Stat(current); serr == nil && info.IsDir() {
+				continue
+			}
+			return err
+		}
+		// The server applies its own default permissions to Mkdir
+		err = client.Chmod(current, mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveDirectoryRecursively deletes dirPath and everything below it. Symlinks
+// are removed rather than followed, so a link never leads the walk outside
+// the tree.
+func (c *SFTPClient) RemoveDirectoryRecursively(dirPath string) error {
+	dirPath = c.resolve(dirPath)
+	return c.withClient("remove", dirPath, func(client *sftp.Client) error {
+		info, err := client.Lstat(dirPath)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dirPath)
+		}
+		return c.removeDirectoryRecursive(dirPath, client)
+	})
+}
+
+func (c *SFTPClient) removeDirectoryRecursive(dirPath string, client *sftp.Client) error {
+	files, err := client.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		filePath := path.Join(dirPath, f.Name())
+		// ReadDir reports symlinks as links, so IsDir never follows one
+		if f.IsDir() {
+			err = c.removeDirectoryRecursive(filePath, client)
+		} else if !c.dryRun("remove", filePath) {
+			err = client.Remove(filePath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Every entry is gone, remove the directory itself
+	if c.dryRun("remove", dirPath) {
+		return nil
+	}
+	return client.RemoveDirectory(dirPath)
+}
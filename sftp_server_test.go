@@ -0,0 +1,165 @@
+package sftp_server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		c    *SFTPClient
+		want string
+	}{
+		{"default port", &SFTPClient{IPAddress: "example.com"}, "example.com:22"},
+		{"port", &SFTPClient{IPAddress: "example.com", Port: "2222"}, "example.com:2222"},
+		{"port number overrides port", &SFTPClient{IPAddress: "example.com", Port: "2222", PortNumber: 2200}, "example.com:2200"},
+		{"ipv4", &SFTPClient{IPAddress: "10.0.0.1", Port: "22"}, "10.0.0.1:22"},
+		{"ipv6", &SFTPClient{IPAddress: "fe80::1"}, "[fe80::1]:22"},
+		{"bracketed ipv6", &SFTPClient{IPAddress: "[fe80::1]", PortNumber: 2222}, "[fe80::1]:2222"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.address(); got != tt.want {
+				t.Errorf("address() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// newPipeClient returns a client talking to an in-process server over pipes,
+// serving the local filesystem.
+func newPipeClient(t *testing.T) *sftp.Client {
+	t.Helper()
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Ends the client's receive loop, which Close waits for
+		sw.Close()
+		client.Close()
+		server.Close()
+	})
+	return client
+}
+
+// newPipeSFTPClient returns an SFTPClient whose calls go to an in-process
+// server, as if Open had connected to it.
+func newPipeSFTPClient(t *testing.T) *SFTPClient {
+	t.Helper()
+	s := newSession(nil, newPipeClient(t))
+	s.borrowed = true
+	return &SFTPClient{session: s}
+}
+
+func TestChmod(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(p, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newPipeSFTPClient(t)
+	for _, mode := range []os.FileMode{0600, 0755, 0440} {
+		if err := c.Chmod(filepath.ToSlash(p), mode); err != nil {
+			t.Fatal(err)
+		}
+		info, err := c.Stat(filepath.ToSlash(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != mode {
+			t.Errorf("after Chmod(%v), Stat mode = %v", mode, got)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(p, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newPipeSFTPClient(t)
+	tests := []struct {
+		name string
+		size int64
+		want []byte
+	}{
+		{"shrink", 4, []byte("0123")},
+		{"extend", 8, []byte("0123\x00\x00\x00\x00")},
+	}
+	for _, tt := range tests {
+		if err := c.Truncate(filepath.ToSlash(p), tt.size); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		info, err := c.Stat(filepath.ToSlash(p))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if info.Size() != tt.size {
+			t.Errorf("%s: Stat size = %d, want %d", tt.name, info.Size(), tt.size)
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, tt.want) {
+			t.Errorf("%s: content = %q, want %q", tt.name, data, tt.want)
+		}
+	}
+}
+
+func TestListerSymlinkLoop(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".", filepath.Join(dir, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := newLister(newPipeClient(t), ListOptions{FollowSymlinks: true}).list(filepath.ToSlash(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	want := []string{"a.txt", "sub/b.txt"}
+	if len(names) != len(want) {
+		t.Fatalf("listed %q, want %q", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("listed %q, want %q", names, want)
+		}
+	}
+}
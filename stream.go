@@ -0,0 +1,368 @@
+package sftp_server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// sessionFile is a remote file whose Close also releases the connection it
+// was opened on.
+type sessionFile struct {
+	*sftp.File
+
+	c *SFTPClient
+	s *session
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (f *sessionFile) Close() error {
+	f.closeOnce.Do(func() {
+		f.closeErr = f.File.Close()
+		f.c.release(f.s)
+	})
+	return f.closeErr
+}
+
+// openSessionFile opens a remote file with open and ties the connection's
+// lifetime to the returned file. Errors are annotated with op and path. If
+// the connection established by Open is found dead it is replaced as in
+// withSession, and open is called again if idempotent is set.
+func (c *SFTPClient) openSessionFile(op, path string, idempotent bool, open func(client *sftp.Client) (*sftp.File, error)) (_ *sessionFile, err error) {
+	done := c.trace(op, path)
+	defer func() { done(err) }()
+
+	ctx := context.Background()
+	s, err := c.acquire(ctx)
+	if err != nil {
+		return nil, opError(op, path, err)
+	}
+
+	f, err := open(s.client)
+	if err != nil {
+		if ns, ok := c.recover(ctx, s, err); ok {
+			c.release(s)
+			s = ns
+			if idempotent {
+				f, err = open(s.client)
+			}
+		}
+	}
+	if err != nil {
+		c.release(s)
+		return nil, opError(op, path, err)
+	}
+	return &sessionFile{File: f, c: c, s: s}, nil
+}
+
+// OpenReader opens a remote file for streaming reads. Closing the reader
+// closes the file and the connection it was opened on. FIFOs, devices and
+// other special files fail with ErrNotRegular.
+func (c *SFTPClient) OpenReader(filePath string) (io.ReadCloser, error) {
+	filePath = c.resolve(filePath)
+	f, err := c.openSessionFile("open", filePath, true, func(client *sftp.Client) (*sftp.File, error) {
+		_, err := statRegular(client, filePath)
+		if err != nil {
+			return nil, err
+		}
+		return client.Open(filePath)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenWriter creates or truncates a remote file for streaming writes. Closing
+// the writer closes the file and the connection it was opened on.
+//
+// Unless Open has been called, every reader or writer holds its own
+// connection, so keep the number of handles open at once small.
+//
+// With DryRun set, the file is left alone and the writer discards the data.
+func (c *SFTPClient) OpenWriter(filePath string) (io.WriteCloser, error) {
+	filePath = c.resolve(filePath)
+	if c.dryRun("create", filePath) {
+		return discardWriter{}, nil
+	}
+	f, err := c.openSessionFile("create", filePath, true, func(client *sftp.Client) (*sftp.File, error) {
+		return client.Create(filePath)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenAppender opens filePath for appending, creating it if needed, and keeps
+// it open so that a loop of small writes, such as log lines, costs one round
+// trip each rather than a reconnect and reopen. Closing the appender closes
+// the file and the connection it was opened on.
+//
+// With DryRun set, the file is left alone and the appender discards the data.
+func (c *SFTPClient) OpenAppender(filePath string) (io.WriteCloser, error) {
+	filePath = c.resolve(filePath)
+	if c.dryRun("append", filePath) {
+		return discardWriter{}, nil
+	}
+	f, err := c.openSessionFile("append", filePath, true, func(client *sftp.Client) (*sftp.File, error) {
+		return client.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// discardWriter stands in for a remote file that DryRun keeps from being
+// written.
+type discardWriter struct{}
+
+func (discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (discardWriter) Close() error                { return nil }
+
+// File is a remote file open for random access.
+type File interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// OpenFile opens filePath with the os.O_* flags in flag, for reading and
+// writing at arbitrary offsets. A file created by the call is given the
+// permissions in mode. Closing the file closes the connection it was opened
+// on.
+//
+// With DryRun set, opening a file for writing, or with flags that would
+// create or truncate it, fails with ErrDryRun.
+func (c *SFTPClient) OpenFile(filePath string, flag int, mode os.FileMode) (File, error) {
+	filePath = c.resolve(filePath)
+	const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_TRUNC
+	if flag&writeFlags != 0 && c.dryRun("open", filePath) {
+		return nil, opError("open", filePath, ErrDryRun)
+	}
+	// A repeated open could miss that the first one created the file, or
+	// fail on O_EXCL because of it
+	idempotent := flag&os.O_CREATE == 0
+	f, err := c.openSessionFile("open", filePath, idempotent, func(client *sftp.Client) (*sftp.File, error) {
+		created := false
+		if flag&os.O_CREATE != 0 {
+			_, err := client.Lstat(filePath)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			created = err != nil
+		}
+
+		f, err := client.OpenFile(filePath, flag)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			// SFTP open takes no mode, the server applies its default
+			err = f.Chmod(mode)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+		return f, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteFromReader creates or truncates filePath and fills it with everything
+// read from r, returning the number of bytes written.
+func (c *SFTPClient) WriteFromReader(filePath string, r io.Reader) (int64, error) {
+	filePath = c.resolve(filePath)
+	if c.dryRun("write", filePath) {
+		return 0, nil
+	}
+	var written int64
+	err := c.withClient("write", filePath, func(client *sftp.Client) error {
+		f, err := client.Create(filePath)
+		if err != nil {
+			return err
+		}
+
+		written, err = io.Copy(f, r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+	return written, err
+}
+
+// ReadLines streams filePath and calls fn with each line, without its line
+// ending, so memory use stays flat however large the file is. Returning
+// false from fn stops reading and closes the file straight away. Lines longer
+// than bufio.MaxScanTokenSize fail with bufio.ErrTooLong.
+func (c *SFTPClient) ReadLines(filePath string, fn func(line string) bool) error {
+	filePath = c.resolve(filePath)
+	return c.withClient("read", filePath, func(client *sftp.Client) error {
+		_, err := statRegular(client, filePath)
+		if err != nil {
+			return err
+		}
+
+		f, err := client.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if !fn(scanner.Text()) {
+				return nil
+			}
+		}
+		return scanner.Err()
+	})
+}
+
+// TailPollInterval is how often Tail checks the file for new data.
+const TailPollInterval = time.Second
+
+// Tail follows filePath like tail -f, calling fn with every complete line
+// appended after Tail starts, without its line ending. If the file shrinks,
+// because it was truncated or rotated, it is reopened and followed from the
+// start. Tail runs until ctx is done and then returns ctx.Err(). With
+// Reconnect set, it carries on over a new connection if the one established
+// by Open drops.
+func (c *SFTPClient) Tail(ctx context.Context, filePath string, fn func(line string)) (err error) {
+	filePath = c.resolve(filePath)
+	done := c.trace("tail", filePath)
+	defer func() { done(err) }()
+
+	err = c.tail(ctx, filePath, fn)
+	if err != nil && err == ctx.Err() {
+		return err
+	}
+	return opError("tail", filePath, err)
+}
+
+func (c *SFTPClient) tail(ctx context.Context, filePath string, fn func(line string)) error {
+	s, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { c.release(s) }()
+
+	f, err := s.client.Open(filePath)
+	if err != nil {
+		return err
+	}
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t := &tailer{path: filePath, fn: fn, f: f, offset: offset}
+	defer func() { t.f.Close() }()
+
+	ticker := time.NewTicker(TailPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		err := t.poll(s.client)
+		if err == nil {
+			continue
+		}
+		// Pick up where it left off on a new connection. Nothing is passed
+		// to fn twice, so following on is safe
+		ns, ok := c.recover(ctx, s, err)
+		if !ok {
+			return err
+		}
+		c.release(s)
+		s = ns
+		err = t.reopen(s.client)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// tailer is Tail's position in the file it follows.
+type tailer struct {
+	path    string
+	fn      func(line string)
+	f       *sftp.File
+	offset  int64
+	pending []byte
+}
+
+// poll passes on any complete lines appended since the last poll.
+func (t *tailer) poll(client *sftp.Client) error {
+	info, err := client.Stat(t.path)
+	if err != nil {
+		return err
+	}
+
+	if info.Size() < t.offset {
+		// Truncated or replaced, start over from the top
+		t.offset = 0
+		t.pending = nil
+		err = t.reopen(client)
+		if err != nil {
+			return err
+		}
+	}
+	if info.Size() == t.offset {
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(t.f, info.Size()-t.offset))
+	if err != nil {
+		return err
+	}
+	t.offset += int64(len(data))
+	t.pending = append(t.pending, data...)
+
+	// Hold back a trailing partial line until the rest of it arrives
+	for {
+		i := bytes.IndexByte(t.pending, '\n')
+		if i < 0 {
+			break
+		}
+		t.fn(string(bytes.TrimSuffix(t.pending[:i], []byte("\r"))))
+		t.pending = t.pending[i+1:]
+	}
+	return nil
+}
+
+// reopen opens the file afresh on client, at the current offset.
+func (t *tailer) reopen(client *sftp.Client) error {
+	t.f.Close()
+	f, err := client.Open(t.path)
+	if err != nil {
+		return err
+	}
+	t.f = f
+	_, err = f.Seek(t.offset, io.SeekStart)
+	return err
+}
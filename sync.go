@@ -0,0 +1,127 @@
+package sftp_server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// SyncOptions controls SyncToRemote.
+type SyncOptions struct {
+	// DeleteExtraneous removes remote files that have no local counterpart.
+	DeleteExtraneous bool
+}
+
+// SyncResult summarises what SyncToRemote changed, or with DryRun set, what
+// it would have changed.
+type SyncResult struct {
+	Added   int
+	Updated int
+	Deleted int
+}
+
+// SyncToRemote makes remoteRoot mirror localRoot. Files missing remotely, or
+// whose size or modification time differ, are uploaded with their local
+// modification time so that the next sync sees them as unchanged. Symlinks
+// and other special files are ignored on both sides.
+func (c *SFTPClient) SyncToRemote(localRoot, remoteRoot string, opts SyncOptions) (SyncResult, error) {
+	remoteRoot = c.resolve(remoteRoot)
+	var result SyncResult
+	err := c.withClient("sync", remoteRoot, func(client *sftp.Client) error {
+		if !path.IsAbs(remoteRoot) {
+			wd, err := client.Getwd()
+			if err != nil {
+				return err
+			}
+			remoteRoot = path.Join(wd, remoteRoot)
+		}
+
+		// Index what is already on the server, if anything
+		remote := make(map[string]fileInfo)
+		_, err := client.Stat(remoteRoot)
+		if err == nil {
+			files, err := newLister(client, ListOptions{SkipSymlinks: true, SkipSpecial: true}).list(remoteRoot)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				remote[f.Name()] = f
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		uploadOpts := TransferOptions{PreserveModTime: true}
+		err = filepath.Walk(localRoot, func(localPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(localRoot, localPath)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			remotePath := path.Join(remoteRoot, rel)
+
+			if info.IsDir() {
+				if c.dryRun("mkdir", remotePath) {
+					return nil
+				}
+				err = createDirectoryRecursive(client, remotePath)
+				if err != nil {
+					return fmt.Errorf("create directory %s: %w", remotePath, err)
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			existing, ok := remote[rel]
+			delete(remote, rel)
+			// SFTP timestamps only have second precision
+			if ok && existing.Size() == info.Size() && existing.ModTime().Equal(info.ModTime().Truncate(time.Second)) {
+				return nil
+			}
+
+			if !c.dryRun("upload", remotePath) {
+				_, err = c.uploadFile(client, localPath, remotePath, uploadOpts)
+				if err != nil {
+					return fmt.Errorf("upload %s: %w", localPath, err)
+				}
+			}
+			if ok {
+				result.Updated++
+			} else {
+				result.Added++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if !opts.DeleteExtraneous {
+			return nil
+		}
+		// Whatever is left in the index has no local counterpart
+		for rel := range remote {
+			remotePath := path.Join(remoteRoot, rel)
+			result.Deleted++
+			if c.dryRun("remove", remotePath) {
+				continue
+			}
+			err = client.Remove(remotePath)
+			if err != nil {
+				return fmt.Errorf("delete %s: %w", remotePath, err)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
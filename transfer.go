@@ -0,0 +1,574 @@
+package sftp_server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// TransferOptions tunes how DownloadFile and UploadFile write their
+// destination. The zero value overwrites an existing destination.
+type TransferOptions struct {
+	// NoOverwrite makes the transfer fail if the destination already exists.
+	NoOverwrite bool
+
+	// PreserveModTime copies the source modification time to the destination.
+	PreserveModTime bool
+
+	// PreserveMode copies the source permission bits to the destination when
+	// uploading. Downloads always keep the remote permissions.
+	PreserveMode bool
+
+	// PreserveMetadata sets both PreserveModTime and PreserveMode, for
+	// faithful backups.
+	PreserveMetadata bool
+
+	// Verify hashes the data with SHA-256 as it is uploaded, then reads the
+	// remote file back and fails with ErrChecksumMismatch if the hashes
+	// differ. This doubles the traffic of an upload.
+	Verify bool
+
+	// Progress, if set, is called as data is copied with the running byte
+	// count and the source size, or -1 if the size is unknown.
+	Progress func(transferred, total int64)
+}
+
+func (o TransferOptions) preserveModTime() bool {
+	return o.PreserveModTime || o.PreserveMetadata
+}
+
+func (o TransferOptions) preserveMode() bool {
+	return o.PreserveMode || o.PreserveMetadata
+}
+
+// progress is an io.Writer that counts the bytes passing through it and
+// reports the running total.
+type progress struct {
+	fn          func(transferred, total int64)
+	transferred int64
+	total       int64
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.transferred += int64(len(b))
+	p.fn(p.transferred, p.total)
+	return len(b), nil
+}
+
+// throttledReader paces reads so that no more than limit bytes per second
+// pass through it on average.
+type throttledReader struct {
+	r     io.Reader
+	limit int64
+	start time.Time
+	read  int64
+}
+
+func newThrottledReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &throttledReader{r: r, limit: limit, start: time.Now()}
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	// Read at most a second's worth at a time to keep the pacing smooth
+	if int64(len(b)) > t.limit {
+		b = b[:t.limit]
+	}
+	n, err := t.r.Read(b)
+	t.read += int64(n)
+
+	due := time.Duration(float64(t.read) / float64(t.limit) * float64(time.Second))
+	if wait := due - time.Since(t.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// DownloadFile streams a remote file to localPath, creating its parent
+// directories, and returns the number of bytes copied. FIFOs, devices and
+// other special files fail with ErrNotRegular.
+func (c *SFTPClient) DownloadFile(remotePath, localPath string) (int64, error) {
+	return c.DownloadFileWithOptions(remotePath, localPath, TransferOptions{})
+}
+
+func (c *SFTPClient) DownloadFileWithOptions(remotePath, localPath string, opts TransferOptions) (int64, error) {
+	remotePath = c.resolve(remotePath)
+	var written int64
+	err := c.withClient("download", remotePath, func(client *sftp.Client) error {
+		var err error
+		written, err = c.downloadFile(client, remotePath, localPath, opts)
+		return err
+	})
+	return written, err
+}
+
+// downloadFile copies remotePath to localPath, creating local parent
+// directories as needed.
+func (c *SFTPClient) downloadFile(client *sftp.Client, remotePath, localPath string, opts TransferOptions) (int64, error) {
+	info, err := statRegular(client, remotePath)
+	if err != nil {
+		return 0, err
+	}
+	// Keep the remote permissions
+	mode := info.Mode().Perm()
+
+	src, err := client.Open(remotePath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	err = os.MkdirAll(filepath.Dir(localPath), 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if opts.NoOverwrite {
+		flag |= os.O_EXCL
+	}
+	dst, err := os.OpenFile(localPath, flag, mode)
+	if err != nil {
+		return 0, err
+	}
+
+	var w io.Writer = dst
+	if opts.Progress != nil {
+		w = io.MultiWriter(dst, &progress{fn: opts.Progress, total: info.Size()})
+	}
+
+	written, err := io.Copy(w, newThrottledReader(src, c.BandwidthLimit))
+	if err != nil {
+		dst.Close()
+		return written, err
+	}
+
+	// OpenFile only applies mode to newly created files
+	err = dst.Chmod(mode)
+	if err != nil {
+		dst.Close()
+		return written, err
+	}
+	err = dst.Close()
+	if err != nil {
+		return written, err
+	}
+
+	if opts.preserveModTime() {
+		return written, os.Chtimes(localPath, info.ModTime(), info.ModTime())
+	}
+	return written, nil
+}
+
+// DownloadDirectory copies the remote tree rooted at remoteRoot to localRoot,
+// recreating its structure, empty directories included. Symlinks and special
+// files are skipped. The error names the file that failed.
+func (c *SFTPClient) DownloadDirectory(remoteRoot, localRoot string) error {
+	return c.DownloadDirectoryWithOptions(remoteRoot, localRoot, TransferOptions{})
+}
+
+func (c *SFTPClient) DownloadDirectoryWithOptions(remoteRoot, localRoot string, opts TransferOptions) error {
+	remoteRoot = path.Clean(c.resolve(remoteRoot))
+	return c.withClient("download", remoteRoot, func(client *sftp.Client) error {
+		info, err := client.Stat(remoteRoot)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", remoteRoot)
+		}
+
+		return walk(context.Background(), client, remoteRoot, info, func(remotePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			// Names come from the server, don't let one escape localRoot
+			rel := filepath.FromSlash(relPath(remoteRoot, remotePath))
+			if !filepath.IsLocal(rel) {
+				return fmt.Errorf("refusing to download %q outside %s", rel, localRoot)
+			}
+			localPath := filepath.Join(localRoot, rel)
+
+			switch {
+			case info.IsDir():
+				// Also recreates directories with nothing in them
+				return os.MkdirAll(localPath, 0755)
+			case info.Mode().IsRegular():
+				_, err = c.downloadFile(client, remotePath, localPath, opts)
+				if err != nil {
+					return fmt.Errorf("download %s: %w", remotePath, err)
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// UploadFile streams a local file to remotePath, creating the remote parent
+// directory if needed, and returns the number of bytes written.
+func (c *SFTPClient) UploadFile(localPath, remotePath string) (int64, error) {
+	return c.UploadFileWithOptions(localPath, remotePath, TransferOptions{})
+}
+
+func (c *SFTPClient) UploadFileWithOptions(localPath, remotePath string, opts TransferOptions) (int64, error) {
+	remotePath = c.resolve(remotePath)
+	if c.dryRun("upload", remotePath) {
+		return 0, nil
+	}
+	var written int64
+	err := c.withClient("upload", remotePath, func(client *sftp.Client) error {
+		err := client.MkdirAll(path.Dir(remotePath))
+		if err != nil {
+			return err
+		}
+
+		written, err = c.uploadFile(client, localPath, remotePath, opts)
+		return err
+	})
+	return written, err
+}
+
+// uploadFile copies localPath to remotePath, whose parent directory must
+// already exist.
+func (c *SFTPClient) uploadFile(client *sftp.Client, localPath, remotePath string, opts TransferOptions) (int64, error) {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if opts.NoOverwrite {
+		flag |= os.O_EXCL
+	}
+	dst, err := client.OpenFile(remotePath, flag)
+	if err != nil {
+		return 0, err
+	}
+
+	r := newThrottledReader(src, c.BandwidthLimit)
+	hash := sha256.New()
+	if opts.Verify {
+		r = io.TeeReader(r, hash)
+	}
+	if opts.Progress != nil {
+		total := int64(-1)
+		if info.Mode().IsRegular() {
+			total = info.Size()
+		}
+		r = io.TeeReader(r, &progress{fn: opts.Progress, total: total})
+	}
+
+	written, err := io.Copy(dst, r)
+	if err != nil {
+		dst.Close()
+		return written, err
+	}
+	err = dst.Close()
+	if err != nil {
+		return written, err
+	}
+
+	if opts.Verify {
+		err = verifyRemote(client, remotePath, hash.Sum(nil))
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if opts.preserveMode() {
+		err = client.Chmod(remotePath, info.Mode().Perm())
+		if err != nil {
+			return written, err
+		}
+	}
+	if opts.preserveModTime() {
+		err = client.Chtimes(remotePath, info.ModTime(), info.ModTime())
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// verifyRemote reads remotePath back and compares its SHA-256 with want.
+// OpenSSH's check-file extension would spare the download, but the sftp
+// package has no way to send it.
+func verifyRemote(client *sftp.Client, remotePath string, want []byte) error {
+	f, err := client.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	if got := hash.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("%w: sent %x, server has %x", ErrChecksumMismatch, want, got)
+	}
+	return nil
+}
+
+// UploadDirectory copies the local tree rooted at localRoot to remoteRoot,
+// keeping its structure. Only regular files are uploaded; symlinks and other
+// special files are skipped. The error names the file that failed.
+func (c *SFTPClient) UploadDirectory(localRoot, remoteRoot string) error {
+	return c.UploadDirectoryWithOptions(localRoot, remoteRoot, TransferOptions{})
+}
+
+func (c *SFTPClient) UploadDirectoryWithOptions(localRoot, remoteRoot string, opts TransferOptions) error {
+	remoteRoot = c.resolve(remoteRoot)
+	return c.withClient("upload", remoteRoot, func(client *sftp.Client) error {
+		// The recursive create builds from the root, so anchor relative
+		// paths at the login directory
+		if !path.IsAbs(remoteRoot) {
+			wd, err := client.Getwd()
+			if err != nil {
+				return err
+			}
+			remoteRoot = path.Join(wd, remoteRoot)
+		}
+
+		return filepath.Walk(localRoot, func(localPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(localRoot, localPath)
+			if err != nil {
+				return err
+			}
+			remotePath := path.Join(remoteRoot, filepath.ToSlash(rel))
+
+			if info.IsDir() {
+				if c.dryRun("mkdir", remotePath) {
+					return nil
+				}
+				err = createDirectoryRecursive(client, remotePath)
+				if err != nil {
+					return fmt.Errorf("create directory %s: %w", remotePath, err)
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			if c.dryRun("upload", remotePath) {
+				return nil
+			}
+
+			_, err = c.uploadFile(client, localPath, remotePath, opts)
+			if err != nil {
+				return fmt.Errorf("upload %s: %w", localPath, err)
+			}
+			return nil
+		})
+	})
+}
+
+// TransferPair names a local file and its remote counterpart.
+type TransferPair struct {
+	Local  string
+	Remote string
+}
+
+// TransferResult is the outcome of one file in UploadFiles.
+type TransferResult struct {
+	Written int64
+	Err     error
+}
+
+// UploadFiles uploads every pair, running up to concurrency uploads at once,
+// each worker on a connection of its own. Remote parent directories are
+// created as needed. The results are keyed by remote path as given in the
+// pair, before BasePath is applied; one failing file does not stop the
+// others.
+//
+// If Open has been called the workers share its connection instead, which
+// keeps the server's session count at one.
+func (c *SFTPClient) UploadFiles(pairs []TransferPair, concurrency int) map[string]TransferResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(pairs) {
+		concurrency = len(pairs)
+	}
+
+	results := make(map[string]TransferResult, len(pairs))
+	var mu sync.Mutex
+
+	work := make(chan TransferPair)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var s *session
+			defer func() {
+				if s != nil {
+					c.release(s)
+				}
+			}()
+
+			for pair := range work {
+				written, err := c.uploadPair(&s, pair)
+				mu.Lock()
+				results[pair.Remote] = TransferResult{Written: written, Err: err}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, pair := range pairs {
+		work <- pair
+	}
+	close(work)
+	wg.Wait()
+
+	return results
+}
+
+// uploadPair uploads one pair for UploadFiles over *s, connecting first if
+// *s is nil. A connection that fails is dropped, or replaced if Reconnect
+// is set, so the next pair does not reuse it.
+func (c *SFTPClient) uploadPair(s **session, pair TransferPair) (written int64, err error) {
+	remote := c.resolve(pair.Remote)
+	if c.dryRun("upload", remote) {
+		return 0, nil
+	}
+
+	done := c.trace("upload", remote)
+	defer func() { done(err) }()
+
+	if *s == nil {
+		*s, err = c.acquire(context.Background())
+		if err != nil {
+			return 0, opError("upload", remote, err)
+		}
+	}
+
+	ctx := context.Background()
+	if c.OperationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.OperationTimeout)
+		defer cancel()
+	}
+	err = c.run(ctx, *s, func(client *sftp.Client) error {
+		err := client.MkdirAll(path.Dir(remote))
+		if err != nil {
+			return err
+		}
+		written, err = c.uploadFile(client, pair.Local, remote, TransferOptions{})
+		return err
+	})
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil && isRetryable(err) {
+		// Give the next pair a live connection. The upload is not repeated,
+		// like any other write
+		ns, _ := c.recover(ctx, *s, err)
+		c.release(*s)
+		*s = ns
+	}
+	return written, opError("upload", remote, err)
+}
+
+// CopyRemote copies srcPath to dstPath on the server, creating the parent
+// directories of dstPath. SFTP has no server-side copy, so the data makes a
+// round trip through this process, but over a single connection.
+func (c *SFTPClient) CopyRemote(srcPath, dstPath string) error {
+	srcPath = c.resolve(srcPath)
+	dstPath = c.resolve(dstPath)
+	if c.dryRun("copy", srcPath+" to "+dstPath) {
+		return nil
+	}
+	return c.withClient("copy", srcPath, func(client *sftp.Client) error {
+		_, err := statRegular(client, srcPath)
+		if err != nil {
+			return err
+		}
+
+		src, err := client.Open(srcPath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		err = client.MkdirAll(path.Dir(dstPath))
+		if err != nil {
+			return err
+		}
+		dst, err := client.Create(dstPath)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(dst, src)
+		if err != nil {
+			dst.Close()
+			return err
+		}
+		return dst.Close()
+	})
+}
+
+// MoveAcrossServers streams srcPath on src to dstPath on dst without touching
+// local disk. With removeSource set, srcPath is deleted once the copy has
+// completed, making it a move. A partially written dstPath is removed if the
+// copy fails.
+func MoveAcrossServers(src *SFTPClient, srcPath string, dst *SFTPClient, dstPath string, removeSource bool) error {
+	if dst.dryRun("upload", dstPath) {
+		return nil
+	}
+
+	r, err := src.OpenReader(srcPath)
+	if err != nil {
+		return fmt.Errorf("source %s: %w", srcPath, err)
+	}
+	defer r.Close()
+
+	w, err := dst.OpenWriter(dstPath)
+	if err != nil {
+		return fmt.Errorf("destination %s: %w", dstPath, err)
+	}
+
+	_, err = io.Copy(w, r)
+	if cerr := w.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("destination %s: %w", dstPath, cerr)
+	}
+	if err != nil {
+		dst.DeleteFile(dstPath)
+		return fmt.Errorf("copy %s to %s: %w", srcPath, dstPath, err)
+	}
+
+	if removeSource {
+		// Close the reader first, some servers refuse to remove open files
+		r.Close()
+		err = src.DeleteFile(srcPath)
+		if err != nil {
+			return fmt.Errorf("source %s: %w", srcPath, err)
+		}
+	}
+	return nil
+}
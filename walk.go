@@ -0,0 +1,149 @@
+package sftp_server
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// WalkFunc is called by Walk for each entry visited, with the same contract
+// as filepath.WalkFunc.
+type WalkFunc func(path string, info os.FileInfo, err error) error
+
+// Walk walks the remote tree rooted at root, calling fn for each file and
+// directory as it is discovered, in the order the server lists them. Symlinks
+// are not followed. Returning
+// filepath.SkipDir from fn skips a directory; returning filepath.SkipAll, or
+// any other error, stops the walk.
+func (c *SFTPClient) Walk(root string, fn WalkFunc) error {
+	return c.WalkContext(context.Background(), root, fn)
+}
+
+// WalkContext is like Walk but stops as soon as ctx is done, between entries
+// or by aborting the request in flight, and then returns an error wrapping
+// ctx.Err(). The entries visited up to that point have been passed to fn.
+func (c *SFTPClient) WalkContext(ctx context.Context, root string, fn WalkFunc) error {
+	root = c.resolve(root)
+	return c.withClientContext(ctx, "walk", root, func(client *sftp.Client) error {
+		info, err := client.Lstat(root)
+		if err != nil {
+			err = fn(root, nil, err)
+		} else {
+			err = walk(ctx, client, root, info, fn)
+		}
+		if err == filepath.SkipDir || err == filepath.SkipAll {
+			return nil
+		}
+		return err
+	})
+}
+
+// relPath returns p, a path reached by walk from root, relative to root.
+// It cannot simply strip len(root) bytes: walk joins children onto "." as
+// bare names, and onto "/" without a second slash.
+func relPath(root, p string) string {
+	root = path.Clean(root)
+	switch {
+	case p == root:
+		return "."
+	case root == ".":
+		return p
+	case root == "/":
+		return strings.TrimPrefix(p, "/")
+	}
+	return strings.TrimPrefix(p, root+"/")
+}
+
+func walk(ctx context.Context, client *sftp.Client, dirPath string, info os.FileInfo, fn WalkFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fn(dirPath, info, nil)
+	}
+
+	files, err := client.ReadDir(dirPath)
+	err1 := fn(dirPath, info, err)
+	// If the directory couldn't be read, fn has already seen the error and
+	// decided whether the walk goes on
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, f := range files {
+		err = walk(ctx, client, path.Join(dirPath, f.Name()), f, fn)
+		if err != nil {
+			if !f.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DirectorySize returns the total size in bytes of the regular files under
+// dirPath, and how many there are. Symlinks are not followed or counted.
+func (c *SFTPClient) DirectorySize(dirPath string) (int64, int, error) {
+	stats, err := c.WalkStats(dirPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	return stats.Size, stats.Files, nil
+}
+
+// TreeStats summarises a directory tree.
+type TreeStats struct {
+	// Files and Size count the regular files and their total size in bytes.
+	Files int
+	Size  int64
+
+	// Dirs counts the directories below the root, not the root itself.
+	Dirs int
+
+	// Oldest and Newest are the earliest and latest modification times of
+	// the regular files, zero if there are none.
+	Oldest time.Time
+	Newest time.Time
+}
+
+// WalkStats gathers a TreeStats for the tree rooted at dirPath in a single
+// walk. Symlinks are not followed or counted.
+func (c *SFTPClient) WalkStats(dirPath string) (TreeStats, error) {
+	var stats TreeStats
+	root := true
+	err := c.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if !root {
+				stats.Dirs++
+			}
+			root = false
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		stats.Files++
+		stats.Size += info.Size()
+		mtime := info.ModTime()
+		if stats.Oldest.IsZero() || mtime.Before(stats.Oldest) {
+			stats.Oldest = mtime
+		}
+		if mtime.After(stats.Newest) {
+			stats.Newest = mtime
+		}
+		return nil
+	})
+	if err != nil {
+		return TreeStats{}, err
+	}
+	return stats, nil
+}